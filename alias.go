@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/samber/lo"
+)
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9-]+`)
+var slugDashes = regexp.MustCompile(`-{2,}`)
+
+// slugify turns names like "feature/Login Form" into a string that can be
+// used as part of a domain: "feature-login-form". Names without a single
+// usable character get a short hash instead, so the slug is never empty
+func slugify(name string) string {
+	slug := strings.ToLower(name)
+	slug = slugInvalidChars.ReplaceAllString(slug, "-")
+	slug = slugDashes.ReplaceAllString(slug, "-")
+	slug = strings.Trim(slug, "-")
+
+	if slug == "" {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:7]
+	}
+	return slug
+}
+
+// Guards App.Aliases, App.ProductionId and App.CustomDomains, which are read
+// by the proxy while they change
+var routesLock sync.RWMutex
+
+// GetAliasDomain returns the stable domain of a branch, pointing at its newest
+// ready deployment. Slugs never contain "--", so the separator keeps alias
+// domains apart from deployment and production domains and from the aliases
+// of other apps
+func (a *App) GetAliasDomain(branch string) string {
+	return fmt.Sprintf("%s--%s.%s", a.GetSlug(), slugify(branch), domain)
+}
+
+func (a *App) GetAliasUrl(branch string) string {
+	return formatUrl(a.GetAliasDomain(branch))
+}
+
+// getAlias returns the id of the deployment the branch alias points at
+func (a *App) getAlias(branch string) (string, bool) {
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
+	id, ok := a.Aliases[branch]
+	return id, ok
+}
+
+// isAliasTarget reports whether a branch alias points at the deployment
+func (a *App) isAliasTarget(deployment *Deployment) bool {
+	id, ok := a.getAlias(deployment.GitBranch)
+	return ok && id == deployment.Id
+}
+
+// setAlias points the branch alias at the deployment with id. Branches like
+// "feature/x" and "feature-x" share an alias domain, it stays with the branch
+// that took it first until its alias is removed
+func (a *App) setAlias(branch, id string) error {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	aliasSlug := slugify(branch)
+	for other := range a.Aliases {
+		if other != branch && slugify(other) == aliasSlug {
+			return fmt.Errorf("Alias domain %s is taken by branch %s", a.GetAliasDomain(branch), other)
+		}
+	}
+
+	if a.Aliases == nil {
+		a.Aliases = make(map[string]string)
+	}
+	a.Aliases[branch] = id
+	return nil
+}
+
+// SetAlias points the branch alias at the deployment, unless it already
+// points at a newer one. Called once the deployment passed readiness
+func (a *App) SetAlias(deployment *Deployment) {
+	if id, ok := a.getAlias(deployment.GitBranch); ok {
+		current := getDeploymentById(id)
+		if current != nil && current.Time.After(deployment.Time) {
+			return
+		}
+	}
+
+	if err := a.setAlias(deployment.GitBranch, deployment.Id); err != nil {
+		log.Println("[Alias]", err)
+		return
+	}
+
+	log.Printf("[Alias] %s -> %s", a.GetAliasDomain(deployment.GitBranch), deployment.GetSlug())
+}
+
+// updateAlias points the branch alias at the newest running deployment of the
+// branch, or removes it if there is none. Called after deployments were removed
+func (a *App) updateAlias(branch string) {
+	var newest *Deployment
+	for _, deployment := range a.GetDeployments() {
+		if deployment.GitBranch != branch {
+			continue
+		}
+		if status := deployment.GetStatus(); status != StateRunning && status != StateSleeping {
+			continue
+		}
+		if newest == nil || deployment.Time.After(newest.Time) {
+			newest = deployment
+		}
+	}
+
+	if newest == nil {
+		routesLock.Lock()
+		delete(a.Aliases, branch)
+		routesLock.Unlock()
+		return
+	}
+	if err := a.setAlias(branch, newest.Id); err != nil {
+		log.Println("[Alias]", err)
+	}
+}
+
+// Rollback points the branch alias at the deployment with targetId, or at the
+// newest ready deployment older than the current alias target if targetId is
+// empty. The next successful deployment of the branch switches it again
+func (a *App) Rollback(branch, targetId string) (*Deployment, error) {
+	isReady := func(d *Deployment) bool {
+		if d.GitBranch != branch {
+			return false
+		}
+		status := d.GetStatus()
+		return status == StateRunning || status == StateSleeping
+	}
+
+	var target *Deployment
+	if targetId != "" {
+		target, _ = lo.Find(a.GetDeployments(), func(d *Deployment) bool {
+			return d.Id == targetId
+		})
+		if target == nil || target.GitBranch != branch {
+			return nil, fmt.Errorf("Unknown deployment of branch %s: %s", branch, targetId)
+		}
+		if !isReady(target) {
+			return nil, fmt.Errorf("Deployment is %s, start it first", target.GetStatus())
+		}
+	} else {
+		id, ok := a.getAlias(branch)
+		if !ok {
+			return nil, fmt.Errorf("Branch has no alias: %s", branch)
+		}
+		current := getDeploymentById(id)
+		if current == nil {
+			return nil, fmt.Errorf("Unknown deployment: %s", id)
+		}
+
+		for _, d := range a.GetDeployments() {
+			if !isReady(d) || !d.Time.Before(current.Time) {
+				continue
+			}
+			if target == nil || d.Time.After(target.Time) {
+				target = d
+			}
+		}
+		if target == nil {
+			return nil, errors.New("No previous running deployment")
+		}
+	}
+
+	if err := a.setAlias(branch, target.Id); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[Alias] Rollback %s -> %s", a.GetAliasDomain(branch), target.GetSlug())
+	return target, nil
+}
+
+// getDeploymentByAlias resolves a branch alias domain. Branches are checked in
+// order, so aliases stored before collisions were refused resolve the same
+// way on every request
+func getDeploymentByAlias(host string) *Deployment {
+	for _, app := range apps {
+		routesLock.RLock()
+		aliases := lo.Assign(app.Aliases)
+		routesLock.RUnlock()
+
+		branches := lo.Keys(aliases)
+		sort.Strings(branches)
+		for _, branch := range branches {
+			if app.GetAliasDomain(branch) == host {
+				return getDeploymentById(aliases[branch])
+			}
+		}
+	}
+
+	return nil
+}
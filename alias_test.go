@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// withRoutingFixture sets the globals used to resolve domains for the test
+func withRoutingFixture(t *testing.T, fixture []*App) {
+	t.Helper()
+
+	previousApps, previousDomain := apps, domain
+	apps, domain = fixture, "example.com"
+	t.Cleanup(func() {
+		apps, domain = previousApps, previousDomain
+	})
+
+	for _, app := range fixture {
+		for _, deployment := range app.Deployments {
+			deployment.App = app
+		}
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"main":               "main",
+		"feature/Login Form": "feature-login-form",
+		"fix--double":        "fix-double",
+		"/leading/":          "leading",
+		"Ünïcode_name":       "n-code-name",
+		// No usable characters, falls back to a hash of the name
+		"日本語": "77710ae",
+		"///": "732c4e9",
+	}
+
+	for name, want := range tests {
+		if got := slugify(name); got != want {
+			t.Errorf("slugify(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGetAliasDomain(t *testing.T) {
+	withRoutingFixture(t, nil)
+
+	foo := &App{Name: "foo"}
+	fooBar := &App{Name: "foo-bar"}
+
+	tests := []struct {
+		app    *App
+		branch string
+		want   string
+	}{
+		{foo, "main", "foo--main.example.com"},
+		{foo, "feature/Login", "foo--feature-login.example.com"},
+		{foo, "bar-x", "foo--bar-x.example.com"},
+		{fooBar, "x", "foo-bar--x.example.com"},
+	}
+
+	for _, test := range tests {
+		if got := test.app.GetAliasDomain(test.branch); got != test.want {
+			t.Errorf("GetAliasDomain(%q, %q) = %q, want %q", test.app.Name, test.branch, got, test.want)
+		}
+	}
+}
+
+func TestGetDeploymentByDomain(t *testing.T) {
+	now := time.Now()
+	fooMain := &Deployment{Id: "foomain", GitBranch: "main", GitCommit: "aaaaaaa1234", Time: now}
+	fooBarX := &Deployment{Id: "foobarx", GitBranch: "bar-x", GitCommit: "bbbbbbb1234", Time: now}
+	prodX := &Deployment{Id: "prodx", GitBranch: "x", GitCommit: "ccccccc1234", Time: now}
+
+	foo := &App{
+		Name:        "foo",
+		Deployments: []*Deployment{fooMain, fooBarX},
+		Aliases:     map[string]string{"main": "foomain", "bar-x": "foobarx"},
+	}
+	fooBar := &App{
+		Name:         "foo-bar",
+		Deployments:  []*Deployment{prodX},
+		ProductionId: ptr("prodx"),
+		CustomDomains: []CustomDomain{
+			{Domain: "www.example.org"},
+			{Domain: "staging.example.org", Branch: "main"},
+		},
+	}
+	withRoutingFixture(t, []*App{foo, fooBar})
+
+	tests := []struct {
+		host string
+		want *Deployment
+	}{
+		{"foo-main-aaaaaaa.example.com", fooMain},
+		{"foo--main.example.com", fooMain},
+		{"foo--bar-x.example.com", fooBarX},
+		// Production domain of foo-bar, not the bar branch of foo
+		{"foo-bar.example.com", prodX},
+		{"foo-bar--x.example.com", nil},
+		{"www.example.org", prodX},
+		// Branch without an alias in foo-bar
+		{"staging.example.org", nil},
+		{"foo.example.com", nil},
+		{"unknown.example.com", nil},
+	}
+
+	for _, test := range tests {
+		if got := getDeploymentByDomain(test.host); got != test.want {
+			t.Errorf("getDeploymentByDomain(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
+
+func TestSetAliasCollision(t *testing.T) {
+	now := time.Now()
+	slash := &Deployment{Id: "slash", GitBranch: "feature/x", GitCommit: "aaaaaaa1234", Time: now}
+	dash := &Deployment{Id: "dash", GitBranch: "feature-x", GitCommit: "bbbbbbb1234", Time: now}
+	app := &App{Name: "foo", Deployments: []*Deployment{slash, dash}}
+	withRoutingFixture(t, []*App{app})
+
+	app.SetAlias(slash)
+	app.SetAlias(dash)
+
+	if _, ok := app.getAlias("feature-x"); ok {
+		t.Error("feature-x took the alias domain of feature/x")
+	}
+	if got := getDeploymentByDomain("foo--feature-x.example.com"); got != slash {
+		t.Errorf("alias domain resolves to %v, want %v", got, slash)
+	}
+	if err := app.setAlias("feature-x", dash.Id); err == nil {
+		t.Error("setAlias(feature-x) succeeded, want collision error")
+	}
+	// The branch holding the domain can still move its alias
+	if err := app.setAlias("feature/x", dash.Id); err != nil {
+		t.Errorf("setAlias(feature/x) error = %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	now := time.Now()
+	deployment := func(id string, status DeploymentState, age time.Duration) *Deployment {
+		return &Deployment{
+			Id:        id,
+			GitBranch: "main",
+			GitCommit: id + "1234567",
+			Time:      now.Add(-age),
+			Status:    status,
+			StateLock: &sync.Mutex{},
+		}
+	}
+	oldest := deployment("oldest", StateRunning, 3*time.Hour)
+	stopped := deployment("stopped", StateStopped, 2*time.Hour)
+	current := deployment("current", StateRunning, time.Hour)
+	app := &App{
+		Name:        "foo",
+		Deployments: []*Deployment{oldest, stopped, current},
+		Aliases:     map[string]string{"main": "current"},
+	}
+	withRoutingFixture(t, []*App{app})
+
+	if _, err := app.Rollback("main", "stopped"); err == nil {
+		t.Error("Rollback to a stopped deployment succeeded")
+	}
+
+	// Skips the stopped deployment
+	target, err := app.Rollback("main", "")
+	if err != nil || target != oldest {
+		t.Fatalf("Rollback() = %v, %v, want %v", target, err, oldest)
+	}
+	if _, err := app.Rollback("main", ""); err == nil {
+		t.Error("Rollback past the oldest deployment succeeded")
+	}
+	if target, err := app.Rollback("main", "current"); err != nil || target != current {
+		t.Errorf("Rollback(current) = %v, %v, want %v", target, err, current)
+	}
+}
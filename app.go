@@ -2,28 +2,49 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
 	"sync"
 	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/samber/lo"
 )
 
 type App struct {
-	Id             string        `json:"id"`
-	Name           string        `json:"name"`
-	Port           *string       `json:"port"`
-	Env            *string       `json:"env"`
-	GitUrl         string        `json:"git_url"`
-	GitUsername    *string       `json:"git_username"`
-	GitPassword    *string       `json:"git_password"`
-	TemplateId     *string       `json:"template_id"`
-	Deployments    []*Deployment `json:"deployments"`
-	WebhookSecret  string        `json:"webhook_secret"`
-	PackageManager string        `json:"package_manager"`
+	Id             string           `json:"id"`
+	Name           string           `json:"name"`
+	Port           *string          `json:"port"`
+	Env            *string          `json:"env"`
+	GitUrl         string           `json:"git_url"`
+	GitUsername    *string          `json:"git_username"`
+	GitPassword    *string          `json:"git_password"`
+	TemplateId     *string          `json:"template_id"`
+	Deployments    []*Deployment    `json:"deployments"`
+	WebhookSecret  string           `json:"webhook_secret"`
+	PackageManager string           `json:"package_manager"`
+	Resources      *ResourceLimits  `json:"resources"`
+	Hooks          *Hooks           `json:"hooks"`
+	Retention      *RetentionPolicy `json:"retention"`
+	// Branch name -> id of the deployment the branch alias domain points at
+	Aliases map[string]string `json:"aliases"`
+	// Deployment served on the production domain <app>.<domain>
+	ProductionId  *string        `json:"production_id"`
+	CustomDomains []CustomDomain `json:"custom_domains"`
+	// Sidecar services added to the template services
+	Services map[string]Service `json:"services"`
+	// Named volumes mounted into run and hook containers
+	Volumes []Volume `json:"volumes"`
+	// Guards Deployments, which are added and removed by requests, webhooks
+	// and the retention watcher
+	deploymentsLock sync.RWMutex
 }
 
 func (a *App) Deploy(gitBranch, gitCommit string) (deployment *Deployment, err error) {
+	if isZeroCommit(gitCommit) {
+		return nil, errors.New("Can not deploy a deleted branch")
+	}
 
 	log.Println(
 		"[Deployment] Deploying branch:",
@@ -36,103 +57,226 @@ func (a *App) Deploy(gitBranch, gitCommit string) (deployment *Deployment, err e
 		a.Id,
 	)
 
-	// templateId, err := a.suggestBuildTemplate(*a.RepoPath)
+	// templateId, err := suggestBuildTemplate(*a.RepoPath)
 	// if err != nil {
 	// 	return err
 	// }
 	// a.TemplateId = ptr(templateId)
-	deployment = &Deployment{
+	deployment = a.newDeployment(gitBranch, gitCommit)
+
+	a.addDeployment(deployment)
+	writeConfig()
+
+	// Build and deploy in background
+	go a.runDeployment(deployment, true)
+
+	return
+}
+
+func (a *App) newDeployment(gitBranch, gitCommit string) *Deployment {
+	deployment := &Deployment{
 		Id:              makeId(),
 		Time:            time.Now(),
 		App:             a,
 		GitBranch:       gitBranch,
 		GitCommit:       gitCommit,
-		Status:          "Initializing Build",
 		RequestsLogLock: &sync.Mutex{},
+		StateLock:       &sync.Mutex{},
 	}
+	deployment.recordState(StatePending, "Deployment created")
 
-	buildJob := &BuildJob{
+	deployment.BuildJob = &BuildJob{
 		Id:         makeId(),
 		Deployment: deployment,
-		Status:     "Building",
+		Status:     BuildRunning,
 	}
-	deployment.BuildJob = buildJob
-
-	a.Deployments = append(a.Deployments, deployment)
-	writeConfig()
-
-	// Build and deploy in background
-	go func(buildJob *BuildJob, deployment *Deployment) {
-		err = buildJob.Run()
-		if err != nil {
-			log.Println("[Build Job]", err)
-		}
 
-		deployment.Status = fmt.Sprintf("Build: %s", buildJob.Status)
+	return deployment
+}
 
-		err = deployment.Run()
+// runDeployment builds (unless the artifact is reused) and starts the
+// deployment
+func (a *App) runDeployment(deployment *Deployment, build bool) {
+	if build {
+		// A failed build never starts a run container
+		err := deployment.BuildJob.Run()
 		if err != nil {
 			log.Println("[Build Job]", err)
+			return
 		}
+	}
 
-		writeConfig()
-	}(buildJob, deployment)
-
-	return
-}
+	// Branch was deleted while building
+	if !a.hasDeployment(deployment) {
+		deployment.Destroy()
+		return
+	}
 
-func (a App) suggestBuildTemplate(path string) (templateId string, err error) {
-	// Select deployment template based on project.json
-	var pkgJson map[string]interface{}
-	pkgJson, err = loadPackageJSON(path)
+	// Services have to be healthy before hooks (e.g. migrations) run
+	err := deployment.RunServices()
 	if err != nil {
+		log.Println("[Services]", err)
 		return
 	}
-	deps, err := parseDependencies(pkgJson)
+
+	// A failing pre deploy hook blocks the deployment
+	err = deployment.RunPreDeployHook()
 	if err != nil {
+		log.Println("[Hooks]", err)
+		deployment.StopServices()
 		return
 	}
-	templateId, err = findTemplateByDependencies(deps)
+
+	err = deployment.Run()
 	if err != nil {
+		log.Println("[Build Job]", err)
+	}
+
+	if !a.hasDeployment(deployment) {
+		deployment.Destroy()
 		return
 	}
 
-	return templateId, nil
+	writeConfig()
 }
 
-func (a *App) GetWebhookUrl() string {
-	s := ""
-	p := ""
-	if ssl {
-		s = "s"
-		if sslPort != "443" {
-			p = fmt.Sprintf(":%s", sslPort)
+// RemoveDeployment removes the deployment from the app and destroys it. Only
+// the first of concurrent calls (e.g. a push and a delete webhook for the same
+// branch) destroys the deployment
+func (a *App) RemoveDeployment(deployment *Deployment) {
+	a.deploymentsLock.Lock()
+	found := lo.Contains(a.Deployments, deployment)
+	a.Deployments = lo.Filter(a.Deployments, func(d *Deployment, _ int) bool {
+		return d.Id != deployment.Id
+	})
+	a.deploymentsLock.Unlock()
+
+	if !found {
+		return
+	}
+
+	// Fall back to the previous deployment of the branch
+	if a.isAliasTarget(deployment) {
+		a.updateAlias(deployment.GitBranch)
+	}
+	// Production is only switched explicitly
+	if a.isProduction(deployment) {
+		routesLock.Lock()
+		a.ProductionId = nil
+		routesLock.Unlock()
+	}
+
+	deployment.Destroy()
+}
+
+// RemoveBranch removes all deployments of a deleted branch, except pinned
+// ones. Pinning is the only way to keep a deployment on purpose, and branches
+// are usually deleted right after merging, which would defeat it
+func (a *App) RemoveBranch(branch string) {
+	log.Println("[Deployment] Branch deleted:", branch, "for app:", a.Name)
+
+	for _, deployment := range a.GetDeployments() {
+		if deployment.GitBranch != branch {
+			continue
 		}
-	} else {
-		if port != "80" {
-			p = fmt.Sprintf(":%s", port)
+		if deployment.Pinned {
+			log.Println("[Deployment] Keeping pinned deployment:", deployment.GetSlug())
+			continue
 		}
 
+		a.RemoveDeployment(deployment)
 	}
-	return fmt.Sprintf("http%s://%s%s/runner/api/app/%s/webhook/", s, domain, p, a.Id)
+
+	routesLock.Lock()
+	delete(a.Aliases, branch)
+	routesLock.Unlock()
+
+	writeConfig()
+}
+
+// hasDeployment reports whether the deployment still belongs to the app. It is
+// removed when its branch is deleted, even while building
+func (a *App) hasDeployment(deployment *Deployment) bool {
+	a.deploymentsLock.RLock()
+	defer a.deploymentsLock.RUnlock()
+
+	return lo.Contains(a.Deployments, deployment)
+}
+
+// GetDeployments returns a copy of the deployments of the app
+func (a *App) GetDeployments() []*Deployment {
+	a.deploymentsLock.RLock()
+	defer a.deploymentsLock.RUnlock()
+
+	return append([]*Deployment(nil), a.Deployments...)
+}
+
+func (a *App) addDeployment(deployment *Deployment) {
+	a.deploymentsLock.Lock()
+	defer a.deploymentsLock.Unlock()
+
+	a.Deployments = append(a.Deployments, deployment)
+}
+
+// GetResources returns the container limits of the template with the app
+// overrides applied
+func (a *App) GetResources(template TemplateConfig) (container.Resources, error) {
+	return template.Resources.Merge(a.Resources).ToDocker()
+}
+
+// suggestBuildTemplate selects a template for the source at path. Templates
+// matching package.json dependencies win over templates matching files
+func suggestBuildTemplate(path string) (templateId string, err error) {
+	// Select deployment template based on project.json
+	pkgJson, err := loadPackageJSON(path)
+	if err == nil {
+		var deps map[string]string
+		deps, err = parseDependencies(pkgJson)
+		if err != nil {
+			return
+		}
+		templateId, err = findTemplateByDependencies(deps)
+		if err == nil {
+			return templateId, nil
+		}
+	}
+
+	return findTemplateByFiles(path)
+}
+
+func (a *App) GetWebhookUrl() string {
+	return fmt.Sprintf("%s/runner/api/app/%s/webhook/", formatUrl(domain), a.Id)
 }
 
 func (a *App) MarshalJSON() ([]byte, error) {
 	type Alias App
 
+	// Copied under the lock, the routes change while deployments finish
+	routesLock.RLock()
+	aliases := lo.Assign(a.Aliases)
+	productionId := a.ProductionId
+	customDomains := append([]CustomDomain{}, a.CustomDomains...)
+	routesLock.RUnlock()
+
 	return json.Marshal(struct {
 		*Alias
-		WebhookUrl string `json:"webhook_url"`
+		Deployments   []*Deployment     `json:"deployments"`
+		Aliases       map[string]string `json:"aliases"`
+		ProductionId  *string           `json:"production_id"`
+		CustomDomains []CustomDomain    `json:"custom_domains"`
+		WebhookUrl    string            `json:"webhook_url"`
+		ProductionUrl string            `json:"production_url"`
 	}{
-		Alias:      (*Alias)(a),
-		WebhookUrl: a.GetWebhookUrl(),
+		Alias:         (*Alias)(a),
+		Deployments:   a.GetDeployments(),
+		Aliases:       aliases,
+		ProductionId:  productionId,
+		CustomDomains: customDomains,
+		WebhookUrl:    a.GetWebhookUrl(),
+		ProductionUrl: a.GetProductionUrl(),
 	})
 }
 
 func (a *App) GetSlug() string {
-	slug := a.Name
-	slug = strings.ToLower(slug)
-	slug = strings.ReplaceAll(slug, " ", "-")
-
-	return slug
+	return slugify(a.Name)
 }
@@ -1,14 +1,13 @@
 package main
 
 import (
-	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
-	"strings"
+	"path/filepath"
 
-	"github.com/docker/docker/api/types"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
@@ -19,25 +18,56 @@ import (
 type BuildJob struct {
 	Id            string      `json:"id"`
 	ContainerId   *string     `json:"container_id"`
-	Status        string      `json:"status"`
+	Status        BuildStatus `json:"status"`
 	ArtifactsPath string      `json:"artifacts_path"`
+	ArtifactImage string      `json:"artifact_image"`
+	LogPath       string      `json:"log_path"`
+	ImageDigest   string      `json:"image_digest"`
 	Deployment    *Deployment `json:"-"`
+	// Local source used instead of cloning the repository (template fixtures)
+	SourcePath string `json:"-"`
 }
 
 func (b *BuildJob) Run() (err error) {
 	// Update build job status
-
-	b.Deployment.Status = "Building"
+	err = b.Deployment.SetState(StateBuilding, "")
+	if err != nil {
+		return
+	}
 	defer func() {
 		if err != nil {
-			b.Status = "Failed"
+			switch failureState(err, StateBuildFailed) {
+			case StateImagePullFailed:
+				b.Status = BuildImagePullFailed
+			case StateOOMKilled:
+				b.Status = BuildOOMKilled
+			default:
+				b.Status = BuildFailed
+			}
+			b.Deployment.SetState(failureState(err, StateBuildFailed), err.Error())
 		} else {
-			b.Status = "Success"
+			b.Status = BuildSuccess
+			b.Deployment.SetState(StateBuilt, "")
 		}
 
 		writeConfig()
 	}()
 
+	// Open persistent build log
+	b.LogPath = getLogPath(b.Deployment.Id, "build")
+	buildLog, err := openLogFile(b.LogPath)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			buildLog.Printf("Build failed: %s", err)
+		} else {
+			buildLog.Printf("Build finished")
+		}
+		buildLog.Close()
+	}()
+
 	// Create tmp mount dir
 	buildDir, err := os.MkdirTemp("./mounts/build", "")
 	if err != nil {
@@ -46,55 +76,120 @@ func (b *BuildJob) Run() (err error) {
 	defer os.RemoveAll(buildDir)
 
 	// Clone src into buildDir
-	err = b.cloneRepo(buildDir)
+	if b.SourcePath != "" {
+		buildLog.Printf("Copying source from %s", b.SourcePath)
+		err = cp.Copy(b.SourcePath, buildDir)
+	} else {
+		buildLog.Printf(
+			"Cloning %s (branch: %s, commit: %s)",
+			b.Deployment.App.GitUrl,
+			b.Deployment.GitBranch,
+			b.Deployment.GitCommit,
+		)
+		err = b.cloneRepo(buildDir, buildLog)
+	}
 	if err != nil {
 		return
 	}
 
-	template := deploymentTemplates[*b.Deployment.App.TemplateId]
+	// Apply runner.toml of the repository
+	if b.Deployment.App.TemplateId == nil {
+		err = fmt.Errorf("App has no template")
+		return
+	}
+	template, found, err := loadRepoConfig(buildDir, *b.Deployment.App.TemplateId)
+	if err != nil {
+		return
+	}
+	if found {
+		buildLog.Printf("Using %s from repository", repoConfigFile)
+	}
+	b.Deployment.Config = &template
 
 	// Write build script into container
-	script := strings.ReplaceAll(template.Build.Script, "%pm%", b.Deployment.App.PackageManager)
+	script, err := renderScript(
+		"build.script",
+		template.Build.Script,
+		newScriptContext(b.Deployment, template),
+	)
+	if err != nil {
+		return
+	}
 
 	buildScript := fmt.Sprintf(
 		"#!/bin/sh\n\ncd /runner/\n\n%s",
 		script,
 	)
 	err = os.WriteFile(path.Join(buildDir, "r_build.sh"), []byte(buildScript), 0755)
+	if err != nil {
+		return
+	}
 
-	// Start container
-	containerId, err := dockerRun(
+	resources, err := b.Deployment.App.GetResources(template)
+	if err != nil {
+		return
+	}
+
+	// Pull image
+	imageDigest, err := dockerEnsureImage(
 		template.Build.Image,
-		"/runner/r_build.sh",
-		nil,
-		nil,
-		nil,
-		buildDir,
+		template.Build.GetPullPolicy(),
+		buildLog,
 	)
 	if err != nil {
 		return
 	}
+	b.ImageDigest = imageDigest
+
+	// Start container
+	buildLog.Printf("Starting build container using image: %s", template.Build.Image)
+	containerId, err := dockerRun(ContainerSpec{
+		Image:     imageDigest,
+		Cmd:       []string{"/runner/r_build.sh"},
+		Env:       formatEnv(b.Deployment.getEnv(template)),
+		Labels:    b.Deployment.containerLabels(RoleBuild),
+		MountPath: buildDir,
+		Resources: resources,
+	})
+	if err != nil {
+		return
+	}
 	b.ContainerId = ptr(containerId)
 
-	// Watch container
-	eChan, errChan := docker.Events(context.Background(), types.EventsOptions{})
-
-LOOP:
-	for {
-		select {
-		case err := <-errChan:
-			log.Fatal(err)
-		case msg := <-eChan:
-			if msg.Type == "container" {
-				if msg.Action == "die" {
-					log.Println("[Docker] Container exited:", msg.Actor.ID)
-					break LOOP
-				}
-			}
-		}
+	// Capture build output until the container exits
+	err = dockerFollowLogs(containerId, buildLog)
+	if err != nil {
+		return
+	}
+	log.Println("[Docker] Container exited:", containerId)
+
+	state, err := dockerWait(containerId)
+	if err != nil {
+		return
+	}
+	if state.OOMKilled {
+		err = ErrOOMKilled
+		return
+	}
+	if state.ExitCode != 0 {
+		err = fmt.Errorf("Build script exited with code %d", state.ExitCode)
+		return
+	}
+
+	// Templates are validated on load, but never copy from outside buildDir
+	if !filepath.IsLocal(template.Build.Artifact) {
+		err = fmt.Errorf("Invalid artifact path: %s", template.Build.Artifact)
+		return
+	}
+
+	// Static deployments are served from the artifact directory
+	if template.Build.GetPackage() == PackageImage && !template.Run.IsStatic() {
+		err = b.packageArtifactImage(buildDir, template, buildLog)
+		return
 	}
 
 	// Save artifact
+	buildLog.Printf("Saving artifact: %s", template.Build.Artifact)
 	artifactDir, err := os.MkdirTemp("./artifacts", "")
 	if err != nil {
 		return
@@ -113,7 +208,36 @@ LOOP:
 	return
 }
 
+// packageArtifactImage turns the artifact into an image based on the run image,
+// so deployments can be started without copying or mounting anything
+func (b *BuildJob) packageArtifactImage(buildDir string, template TemplateConfig, buildLog *LogFile) error {
+	runImageDigest, err := dockerEnsureImage(
+		template.Run.Image,
+		template.Run.GetPullPolicy(),
+		buildLog,
+	)
+	if err != nil {
+		return err
+	}
+
+	tag := fmt.Sprintf("runner-artifact:%s", b.Deployment.Id)
+	buildLog.Printf("Packaging artifact %s as image: %s", template.Build.Artifact, tag)
+
+	err = dockerBuildArtifactImage(buildDir, template.Build.Artifact, runImageDigest, tag, buildLog)
+	if err != nil {
+		return err
+	}
+
+	b.ArtifactImage = tag
+	return nil
+}
+
 func (b *BuildJob) GetLogs() (logs string, err error) {
+	if b.LogPath != "" {
+		return readLogFile(b.LogPath)
+	}
+
+	// Deployments built before logs were persisted
 	if b.ContainerId == nil {
 		return "", fmt.Errorf("No build container found yet")
 	}
@@ -121,7 +245,7 @@ func (b *BuildJob) GetLogs() (logs string, err error) {
 	return
 }
 
-func (b *BuildJob) cloneRepo(path string) error {
+func (b *BuildJob) cloneRepo(path string, progress io.Writer) error {
 	branchRef := plumbing.ReferenceName(
 		fmt.Sprintf("refs/heads/%s", b.Deployment.GitBranch),
 	)
@@ -130,6 +254,7 @@ func (b *BuildJob) cloneRepo(path string) error {
 		URL:           b.Deployment.App.GitUrl,
 		SingleBranch:  true,
 		ReferenceName: branchRef,
+		Progress:      progress,
 	}
 	if b.Deployment.App.GitUsername != nil && b.Deployment.App.GitPassword != nil {
 		options.Auth = &http.BasicAuth{
@@ -155,6 +280,7 @@ func (b *BuildJob) cloneRepo(path string) error {
 
 		err = repo.Fetch(&git.FetchOptions{
 			RefSpecs: []config.RefSpec{"refs/*:refs/*", "HEAD:refs/heads/HEAD"},
+			Progress: progress,
 		})
 		if err != nil {
 			return err
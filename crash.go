@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/samber/lo"
+)
+
+// Restart policies
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const (
+	defaultMaxRestarts = 5
+	defaultBackoff     = time.Second
+	defaultMaxBackoff  = time.Minute
+	// Containers running longer than this are considered stable again and
+	// their restart backoff starts over
+	restartResetAfter = 10 * time.Minute
+)
+
+// RestartPolicy decides whether a crashed run container is restarted. The
+// delay before a restart doubles with every consecutive crash
+type RestartPolicy struct {
+	// "on-failure" (default), "always" or "never"
+	Policy      string `toml:"policy"       json:"policy"`
+	MaxRestarts *int   `toml:"max_restarts" json:"max_restarts"`
+	Backoff     string `toml:"backoff"      json:"backoff"`
+	MaxBackoff  string `toml:"max_backoff"  json:"max_backoff"`
+}
+
+func (r RestartPolicy) GetPolicy() string {
+	if r.Policy == "" {
+		return RestartOnFailure
+	}
+	return r.Policy
+}
+
+func (r RestartPolicy) GetMaxRestarts() int {
+	if r.MaxRestarts == nil {
+		return defaultMaxRestarts
+	}
+	return *r.MaxRestarts
+}
+
+func (r RestartPolicy) Validate() error {
+	if !lo.Contains([]string{RestartNever, RestartOnFailure, RestartAlways}, r.GetPolicy()) {
+		return fmt.Errorf("invalid policy: %s", r.Policy)
+	}
+	if r.GetMaxRestarts() < 0 {
+		return fmt.Errorf("max_restarts must not be negative")
+	}
+	if _, err := parseProbeDuration(r.Backoff, defaultBackoff); err != nil {
+		return fmt.Errorf("backoff: %w", err)
+	}
+	if _, err := parseProbeDuration(r.MaxBackoff, defaultMaxBackoff); err != nil {
+		return fmt.Errorf("max_backoff: %w", err)
+	}
+	return nil
+}
+
+// shouldRestart reports whether a container that exited with exitCode after
+// restarts consecutive restarts is started again
+func (r RestartPolicy) shouldRestart(exitCode int, restarts int) bool {
+	switch r.GetPolicy() {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		if exitCode == 0 {
+			return false
+		}
+	}
+	return restarts < r.GetMaxRestarts()
+}
+
+// getBackoff returns the delay before the given restart (starting at 1)
+func (r RestartPolicy) getBackoff(restart int) time.Duration {
+	backoff, _ := parseProbeDuration(r.Backoff, defaultBackoff)
+	maxBackoff, _ := parseProbeDuration(r.MaxBackoff, defaultMaxBackoff)
+
+	for i := 1; i < restart && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// watchContainers updates deployments when their run container dies. The
+// docker event stream is reconnected if it fails
+func watchContainers() {
+	for {
+		// Containers might have exited while not watching
+		for _, deployment := range getAllDeployments() {
+			deployment.CheckContainer()
+		}
+
+		err := dockerWatch(handleContainerEvent)
+		log.Println("[Watcher] Docker event stream failed:", err)
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func handleContainerEvent(msg events.Message) {
+	deployment := getDeploymentById(msg.Actor.Attributes[labelDeployment])
+	if deployment == nil || deployment.ContainerId == nil || *deployment.ContainerId != msg.Actor.ID {
+		return
+	}
+
+	switch msg.Action {
+	case "oom":
+		log.Println("[Watcher]", deployment.GetSlug(), "Out of memory")
+	case "die":
+		deployment.CheckContainer()
+	}
+}
+
+// handleCrash records a crash of the run container and schedules a restart
+// according to the restart policy
+func (d *Deployment) handleCrash(exitCode int, oomKilled bool) {
+	state := StateCrashed
+	reason := fmt.Sprintf("Container exited with code %d", exitCode)
+	if oomKilled {
+		state = StateOOMKilled
+		reason = ErrOOMKilled.Error()
+	}
+
+	// Fails if the crash was already handled or the deployment was stopped
+	previous, err := d.swapState(nil, state, reason)
+	if err != nil {
+		return
+	}
+	wasRunning := previous == StateRunning
+
+	// Start over if the container was stable for a while
+	lastStart, ok := d.lastTransitionTo(StateRunning)
+	if wasRunning && ok && time.Since(lastStart) > restartResetAfter {
+		d.Restarts = 0
+	}
+
+	d.CrashCount++
+	d.LastExitCode = ptr(exitCode)
+	d.LastCrashAt = ptr(time.Now())
+	d.scheduleRestart(exitCode)
+	writeConfig()
+}
+
+// scheduleRestart restarts the crashed deployment after the backoff, if the
+// restart policy allows it. The time is recorded, so a restart that is still
+// pending when runner stops is resumed on the next start
+func (d *Deployment) scheduleRestart(exitCode int) {
+	template, err := d.getTemplate()
+	if err != nil {
+		log.Println("[Watcher]", err)
+		return
+	}
+
+	policy := template.Run.Restart
+	if !policy.shouldRestart(exitCode, d.Restarts) {
+		log.Printf("[Watcher] %s: Not restarting (policy: %s, restarts: %d)", d.GetSlug(), policy.GetPolicy(), d.Restarts)
+		return
+	}
+
+	d.Restarts++
+	backoff := policy.getBackoff(d.Restarts)
+	d.RestartAt = ptr(time.Now().Add(backoff))
+	log.Printf("[Watcher] %s: Restarting in %s (restart %d)", d.GetSlug(), backoff, d.Restarts)
+
+	go d.restartAfter(backoff)
+}
+
+func (d *Deployment) restartAfter(backoff time.Duration) {
+	time.Sleep(backoff)
+	d.RestartAt = nil
+
+	// Skipped if the deployment was stopped or started in the meantime
+	err := d.start(
+		[]DeploymentState{StateCrashed, StateOOMKilled},
+		fmt.Sprintf("Restart %d after crash", d.Restarts),
+	)
+	if err != nil {
+		log.Println("[Watcher]", d.GetSlug(), err)
+	}
+}
+
+// resumeRestarts continues restarting crashed deployments after runner was
+// restarted. Pending restarts keep their time, for all others the restart
+// policy is checked again
+func resumeRestarts() {
+	for _, deployment := range getAllDeployments() {
+		status := deployment.GetStatus()
+		if status != StateCrashed && status != StateOOMKilled {
+			continue
+		}
+
+		if deployment.RestartAt != nil {
+			backoff := max(time.Until(*deployment.RestartAt), 0)
+			log.Printf("[Watcher] %s: Resuming restart in %s", deployment.GetSlug(), backoff)
+			go deployment.restartAfter(backoff)
+		} else if deployment.LastExitCode != nil {
+			deployment.scheduleRestart(*deployment.LastExitCode)
+		}
+	}
+	writeConfig()
+}
+
+func (d *Deployment) lastTransitionTo(state DeploymentState) (time.Time, bool) {
+	transition, _, ok := lo.FindLastIndexOf(d.GetTimeline(), func(t StateTransition) bool {
+		return t.To == state
+	})
+	return transition.Time, ok
+}
+
+// inspectExit returns whether the container is still running, and otherwise
+// its exit code and whether it was OOM killed
+func inspectExit(containerId string) (running bool, exitCode int, oomKilled bool, err error) {
+	inspect, err := docker.ContainerInspect(context.Background(), containerId)
+	if err != nil {
+		return
+	}
+
+	return inspect.State.Running, inspect.State.ExitCode, inspect.State.OOMKilled, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShouldRestart(t *testing.T) {
+	tests := []struct {
+		policy   RestartPolicy
+		exitCode int
+		restarts int
+		want     bool
+	}{
+		{RestartPolicy{}, 1, 0, true},
+		{RestartPolicy{}, 0, 0, false},
+		{RestartPolicy{}, 1, 4, true},
+		{RestartPolicy{}, 1, 5, false},
+		{RestartPolicy{Policy: RestartAlways}, 0, 0, true},
+		{RestartPolicy{Policy: RestartAlways}, 0, 5, false},
+		{RestartPolicy{Policy: RestartNever}, 1, 0, false},
+		{RestartPolicy{MaxRestarts: ptr(0)}, 1, 0, false},
+		{RestartPolicy{MaxRestarts: ptr(10)}, 137, 9, true},
+	}
+
+	for _, test := range tests {
+		got := test.policy.shouldRestart(test.exitCode, test.restarts)
+		if got != test.want {
+			t.Errorf("%+v.shouldRestart(%d, %d) = %v, want %v", test.policy, test.exitCode, test.restarts, got, test.want)
+		}
+	}
+}
+
+func TestGetBackoff(t *testing.T) {
+	tests := []struct {
+		policy  RestartPolicy
+		restart int
+		want    time.Duration
+	}{
+		{RestartPolicy{}, 1, time.Second},
+		{RestartPolicy{}, 2, 2 * time.Second},
+		{RestartPolicy{}, 3, 4 * time.Second},
+		{RestartPolicy{}, 7, time.Minute},
+		{RestartPolicy{}, 100, time.Minute},
+		{RestartPolicy{Backoff: "500ms"}, 3, 2 * time.Second},
+		{RestartPolicy{Backoff: "10s", MaxBackoff: "15s"}, 2, 15 * time.Second},
+		{RestartPolicy{Backoff: "1m", MaxBackoff: "30s"}, 1, 30 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.getBackoff(test.restart); got != test.want {
+			t.Errorf("%+v.getBackoff(%d) = %s, want %s", test.policy, test.restart, got, test.want)
+		}
+	}
+}
+
+func TestSwapState(t *testing.T) {
+	crashedStates := []DeploymentState{StateCrashed, StateOOMKilled}
+
+	tests := []struct {
+		status  DeploymentState
+		from    []DeploymentState
+		to      DeploymentState
+		wantErr bool
+	}{
+		{StateRunning, nil, StateCrashed, false},
+		{StateCrashed, nil, StateCrashed, true},
+		{StateCrashed, crashedStates, StateStarting, false},
+		{StateOOMKilled, crashedStates, StateStarting, false},
+		// Stopped during the restart backoff
+		{StateStopped, crashedStates, StateStarting, true},
+		{StateStopped, nil, StateStarting, false},
+	}
+
+	for _, test := range tests {
+		d := &Deployment{
+			GitCommit: "0123456789abcdef",
+			Status:    test.status,
+			StateLock: &sync.Mutex{},
+			App:       &App{Name: "app"},
+		}
+
+		previous, err := d.swapState(test.from, test.to, "test")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s -> %s: error = %v, want error: %v", test.status, test.to, err, test.wantErr)
+		}
+		if previous != test.status {
+			t.Errorf("%s -> %s: previous = %s", test.status, test.to, previous)
+		}
+
+		want := test.to
+		if test.wantErr {
+			want = test.status
+		}
+		if d.Status != want {
+			t.Errorf("%s -> %s: status = %s, want %s", test.status, test.to, d.Status, want)
+		}
+	}
+}
+
+func TestScheduleRestart(t *testing.T) {
+	tests := []struct {
+		policy       RestartPolicy
+		exitCode     int
+		restarts     int
+		wantRestarts int
+		wantPending  bool
+	}{
+		{RestartPolicy{Policy: RestartNever}, 1, 0, 0, false},
+		{RestartPolicy{}, 0, 0, 0, false},
+		{RestartPolicy{MaxRestarts: ptr(2)}, 1, 2, 2, false},
+		// The backoff is long enough that the restart never runs in the test
+		{RestartPolicy{Backoff: "1h"}, 1, 0, 1, true},
+		{RestartPolicy{Policy: RestartAlways, Backoff: "1h"}, 0, 1, 2, true},
+	}
+
+	for i, test := range tests {
+		d := &Deployment{
+			GitCommit: "0123456789abcdef",
+			Status:    StateCrashed,
+			Restarts:  test.restarts,
+			StateLock: &sync.Mutex{},
+			App:       &App{Name: "app"},
+			Config:    &TemplateConfig{Run: StepRun{Restart: test.policy}},
+		}
+
+		d.scheduleRestart(test.exitCode)
+		if d.Restarts != test.wantRestarts {
+			t.Errorf("%d: restarts = %d, want %d", i, d.Restarts, test.wantRestarts)
+		}
+		if (d.RestartAt != nil) != test.wantPending {
+			t.Errorf("%d: restart at = %v, want pending: %v", i, d.RestartAt, test.wantPending)
+		}
+	}
+}
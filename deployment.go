@@ -2,33 +2,61 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/docker/docker/client"
 	cp "github.com/otiai10/copy"
+	"github.com/samber/lo"
 )
 
 type Deployment struct {
-	Id              string      `json:"id"`
-	Time            time.Time   `json:"time"`
-	ContainerId     *string     `json:"container_id"`
-	GitBranch       string      `json:"git_branch"`
-	GitCommit       string      `json:"git_commit"`
-	Status          string      `json:"status"`
-	Port            *string     `json:"port"`
-	BuildJob        *BuildJob   `json:"build_job"`
-	RequestsLog     []string    `json:"-"`
-	RequestsLogLock *sync.Mutex `json:"-"`
-	App             *App        `json:"-"`
+	Id          string            `json:"id"`
+	Time        time.Time         `json:"time"`
+	ContainerId *string           `json:"container_id"`
+	GitBranch   string            `json:"git_branch"`
+	GitCommit   string            `json:"git_commit"`
+	Status      DeploymentState   `json:"status"`
+	Timeline    []StateTransition `json:"timeline"`
+	// Host port of deployments started before app networks
+	Port *string `json:"port"`
+	// Address of the run container on the app network
+	Address      *string `json:"address"`
+	ImageDigest  string  `json:"image_digest"`
+	HooksLogPath string  `json:"hooks_log_path"`
+	// Run directory in ./mounts/running, empty for artifact images
+	WorkDir string `json:"work_dir"`
+	// Pinned deployments are never removed by retention policies
+	Pinned bool `json:"pinned"`
+	// Overrides the app env, set by redeploys
+	Env *string `json:"env"`
+	// Sidecar services started with the deployment
+	Services []ServiceContainer `json:"services"`
+	// Crashes of the run container and consecutive restarts
+	CrashCount   int        `json:"crash_count"`
+	Restarts     int        `json:"restarts"`
+	LastExitCode *int       `json:"last_exit_code"`
+	LastCrashAt  *time.Time `json:"last_crash_at"`
+	// Set while a restart after a crash is pending
+	RestartAt *time.Time `json:"restart_at"`
+	// Used to stop idle deployments
+	LastRequestAt time.Time `json:"last_request_at"`
+	// Effective template including runner.toml overrides, set by the build
+	Config          *TemplateConfig `json:"config"`
+	BuildJob        *BuildJob       `json:"build_job"`
+	RequestsLog     []string        `json:"-"`
+	RequestsLogLock *sync.Mutex     `json:"-"`
+	StateLock       *sync.Mutex     `json:"-"`
+	App             *App            `json:"-"`
 }
 
 func (d Deployment) GetSlug() string {
-	return fmt.Sprintf("%s-%s-%s", d.App.GetSlug(), d.GitBranch, d.GitCommit[:7])
+	return fmt.Sprintf("%s-%s-%s", d.App.GetSlug(), slugify(d.GitBranch), d.GitCommit[:7])
 }
 
 func (d Deployment) GetDomain() string {
@@ -36,20 +64,7 @@ func (d Deployment) GetDomain() string {
 }
 
 func (d Deployment) GetUrl() string {
-	s := ""
-	p := ""
-	if ssl {
-		s = "s"
-		if sslPort != "443" {
-			p = fmt.Sprintf(":%s", sslPort)
-		}
-	} else {
-		if port != "80" {
-			p = fmt.Sprintf(":%s", port)
-		}
-
-	}
-	return fmt.Sprintf("http%s://%s%s", s, d.GetDomain(), p)
+	return formatUrl(d.GetDomain())
 }
 
 func (d Deployment) GetName() string {
@@ -60,76 +75,294 @@ func (d Deployment) GetName() string {
 func (d *Deployment) MarshalJSON() ([]byte, error) {
 	type Alias Deployment
 
+	// Set if the branch alias points at this deployment
+	aliasUrl := ""
+	if d.App.isAliasTarget(d) {
+		aliasUrl = d.App.GetAliasUrl(d.GitBranch)
+	}
+
+	// Copied under the lock, the state changes while the deployment runs
+	d.StateLock.Lock()
+	status := d.Status
+	timeline := append([]StateTransition(nil), d.Timeline...)
+	d.StateLock.Unlock()
+
 	return json.Marshal(struct {
 		*Alias
-		Name string `json:"name"`
-		Url  string `json:"url"`
+		Status   DeploymentState   `json:"status"`
+		Timeline []StateTransition `json:"timeline"`
+		Name     string            `json:"name"`
+		Url      string            `json:"url"`
+		AliasUrl string            `json:"alias_url,omitempty"`
 	}{
-		Alias: (*Alias)(d),
-		Name:  d.GetName(),
-		Url:   d.GetUrl(),
+		Alias:    (*Alias)(d),
+		Status:   status,
+		Timeline: timeline,
+		Name:     d.GetName(),
+		Url:      d.GetUrl(),
+		AliasUrl: aliasUrl,
 	})
 }
 
 func (d *Deployment) Run() (err error) {
-	// Update status
+	// Update status. Only built deployments can be started
+	err = d.SetState(StateStarting, "")
+	if err != nil {
+		return
+	}
 	defer func() {
 		if err != nil {
-			d.Status = "Failed"
+			d.SetState(failureState(err, StateFailed), err.Error())
+			d.StopServices()
 		} else {
-			d.Status = "Running"
+			d.SetState(StateRunning, "")
+			// Ready, switch the branch alias
+			d.App.SetAlias(d)
 		}
 
 		writeConfig()
 	}()
 
-	template := deploymentTemplates[*d.App.TemplateId]
+	buildLog, err := d.openBuildLog()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			buildLog.Printf("Deployment failed: %s", err)
+		}
+		buildLog.Close()
+	}()
 
-	// Select random host port for container
-	port, err := getFreePort()
+	template, err := d.getTemplate()
 	if err != nil {
 		return
 	}
-	d.Port = ptr(strconv.Itoa(port))
 
-	// Create tmp mount dir
-	workDir, err := os.MkdirTemp("./mounts/running", "")
+	if template.Run.IsStatic() {
+		root := d.getStaticRoot(template)
+		if _, err = os.Stat(root); err != nil {
+			return
+		}
+
+		buildLog.Printf("Serving static files from %s", template.Build.Artifact)
+		buildLog.Printf("Deployment is running at %s", d.GetUrl())
+		return
+	}
+
+	spec, err := d.prepareContainer(template, template.Run.Script, "r_run.sh", RoleRun, buildLog)
 	if err != nil {
 		return
 	}
+	d.WorkDir = spec.MountPath
+	d.ImageDigest = spec.Image
 
-	// Copy artifacts into workDir
-	err = cp.Copy(d.BuildJob.ArtifactsPath, workDir)
+	// Start container
+	buildLog.Printf("Starting run container using image: %s", spec.Image)
+	containerId, err := dockerRun(spec)
 	if err != nil {
 		return
 	}
+	d.ContainerId = ptr(containerId)
 
-	// Write run script into container
-	script := strings.ReplaceAll(template.Run.Script, "%pm%", d.App.PackageManager)
+	err = d.updateAddress(template)
+	if err != nil {
+		dockerStop(containerId)
+		return
+	}
+
+	// Only route requests to the container once it accepts them
+	err = d.waitReady(template, buildLog)
+	if err != nil {
+		dockerStop(containerId)
+		return
+	}
+
+	// Block the deployment until the post deploy hook succeeded
+	err = d.RunPostDeployHook()
+	if err != nil {
+		dockerStop(containerId)
+		return
+	}
+
+	buildLog.Printf("Deployment is running at %s", d.GetUrl())
+
+	return
+}
+
+// getTemplate returns the effective config recorded during the build, or the
+// current app template for deployments that have not been built yet
+func (d *Deployment) getTemplate() (TemplateConfig, error) {
+	if d.Config != nil {
+		return *d.Config, nil
+	}
 
-	runScript := fmt.Sprintf(
+	if d.App.TemplateId == nil {
+		return TemplateConfig{}, errors.New("App has no template")
+	}
+
+	template, ok := getTemplate(*d.App.TemplateId)
+	if !ok {
+		return TemplateConfig{}, fmt.Errorf("Unknown template: %s", *d.App.TemplateId)
+	}
+
+	return template, nil
+}
+
+// getEnv returns the container env: the template env and service connection
+// details overridden by the app env and the deployment env
+func (d *Deployment) getEnv(template TemplateConfig) map[string]string {
+	return lo.Assign(
+		template.Env,
+		d.getServiceEnv(template),
+		parseEnv(d.App.Env),
+		parseEnv(d.Env),
+	)
+}
+
+func (d *Deployment) containerLabels(role string) map[string]string {
+	return map[string]string{
+		labelDeployment: d.Id,
+		labelApp:        d.App.Id,
+		labelRole:       role,
+	}
+}
+
+// prepareContainer creates a container spec for the built environment that
+// executes script. Used for the run container and hooks
+func (d *Deployment) prepareContainer(
+	template TemplateConfig,
+	script, scriptName, role string,
+	buildLog *LogFile,
+) (spec ContainerSpec, err error) {
+	script, err = renderScript(scriptName, script, newScriptContext(d, template))
+	if err != nil {
+		return
+	}
+	script = fmt.Sprintf(
 		"#!/bin/sh\n\ncd /runner/\n\n%s",
 		script,
 	)
-	err = os.WriteFile(path.Join(workDir, "r_run.sh"), []byte(runScript), 0755)
 
-	// Start container
-	containerId, err := dockerRun(
+	spec.Env = formatEnv(d.getEnv(template))
+	spec.Labels = d.containerLabels(role)
+	spec.Network, err = d.App.ensureNetwork()
+	if err != nil {
+		return
+	}
+	spec.Resources, err = d.App.GetResources(template)
+	if err != nil {
+		return
+	}
+
+	if d.BuildJob.ArtifactImage != "" {
+		// Artifact is already part of the image. The tag can be moved, so run
+		// the image it points at now
+		spec.Image, err = dockerImageDigest(d.BuildJob.ArtifactImage)
+		if err != nil {
+			return
+		}
+		spec.Cmd = []string{"/bin/sh", "-c", script}
+		err = d.mountVolumes(&spec, buildLog)
+		return
+	}
+
+	// Create tmp mount dir
+	workDir, err := os.MkdirTemp("./mounts/running", "")
+	if err != nil {
+		return
+	}
+
+	// Copy artifacts into workDir
+	buildLog.Printf("Copying artifacts into run directory")
+	err = cp.Copy(d.BuildJob.ArtifactsPath, workDir)
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(path.Join(workDir, scriptName), []byte(script), 0755)
+	if err != nil {
+		return
+	}
+
+	// Pull image
+	imageDigest, err := dockerEnsureImage(
 		template.Run.Image,
-		"/runner/r_run.sh",
-		nil,
-		ptr(template.Run.Port),
-		ptr(strconv.Itoa(port)),
-		workDir,
+		template.Run.GetPullPolicy(),
+		buildLog,
 	)
 	if err != nil {
 		return
 	}
-	d.ContainerId = ptr(containerId)
+
+	spec.Image = imageDigest
+	spec.Cmd = []string{path.Join("/runner", scriptName)}
+	spec.MountPath = workDir
+	err = d.mountVolumes(&spec, buildLog)
 
 	return
 }
 
+// CheckContainer detects a crashed run container, e.g. after a proxy error or
+// docker events that were missed while runner was not watching
+func (d *Deployment) CheckContainer() {
+	if d.ContainerId == nil || d.GetStatus() != StateRunning {
+		return
+	}
+
+	running, exitCode, oomKilled, err := inspectExit(*d.ContainerId)
+	if client.IsErrNotFound(err) {
+		d.SetState(StateFailed, "Container was removed")
+		writeConfig()
+		return
+	}
+	if err != nil {
+		log.Println("[Deployment]", err)
+		return
+	}
+
+	if !running {
+		d.handleCrash(exitCode, oomKilled)
+	}
+}
+
+// Destroy removes the container and all data of the deployment
+func (d *Deployment) Destroy() {
+	if d.ContainerId != nil {
+		dockerStop(*d.ContainerId)
+		dockerRemove(*d.ContainerId)
+	}
+	d.removeServices()
+	d.removeVolumes()
+	if d.BuildJob != nil && d.BuildJob.ArtifactImage != "" {
+		if err := dockerRemoveImage(d.BuildJob.ArtifactImage); err != nil {
+			log.Println("[Deployment]", err)
+		}
+	}
+	if d.WorkDir != "" {
+		os.RemoveAll(d.WorkDir)
+	}
+	if d.BuildJob != nil && d.BuildJob.ArtifactsPath != "" {
+		os.RemoveAll(d.BuildJob.ArtifactsPath)
+	}
+	removeLogs(d.Id)
+}
+
+func (d *Deployment) GetHooksLogs() (string, error) {
+	if d.HooksLogPath == "" {
+		return "", fmt.Errorf("No hooks have run yet")
+	}
+	return readLogFile(d.HooksLogPath)
+}
+
+// openBuildLog opens the build log for appending runner side deployment steps
+func (d *Deployment) openBuildLog() (*LogFile, error) {
+	if d.BuildJob.LogPath == "" {
+		d.BuildJob.LogPath = getLogPath(d.Id, "build")
+	}
+	return openLogFile(d.BuildJob.LogPath)
+}
+
 func (d *Deployment) GetLogs() (logs string, err error) {
 	if d.ContainerId == nil {
 		return "", fmt.Errorf("No container found yet")
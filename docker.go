@@ -1,25 +1,41 @@
 package main
 
 import (
+	"archive/tar"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/stdcopy"
-	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
 )
 
 var docker *client.Client
 
+// Image pull policies
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
 func connectDocker() {
 	var err error
 	docker, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -28,79 +44,96 @@ func connectDocker() {
 	}
 }
 
-func dockerRun(
-	image, cmd string, env, port, hostPort *string,
-	mountPath string,
-) (string, error) {
-	var cmdParts []string
-	if cmd != "" {
-		cmdParts = strings.Split(cmd, " ")
-	}
+// Labels of all containers started by runner
+const (
+	labelDeployment = "runner.deployment"
+	labelApp        = "runner.app"
+	labelRole       = "runner.role"
+	labelService    = "runner.service"
+)
 
-	_, err := docker.ImagePull(
-		context.Background(),
-		image,
-		types.ImagePullOptions{},
-	)
-	if err != nil {
-		return "", err
-	}
-	// defer reader.Close()
-	// // Read docker pull logs
-	// buf := new(strings.Builder)
-	// _, err = stdcopy.StdCopy(buf, buf, reader)
-	// pullLogContent := buf.String()
+// Container roles (runner.role label)
+const (
+	RoleBuild   = "build"
+	RoleHook    = "hook"
+	RoleRun     = "run"
+	RoleService = "service"
+)
+
+// ContainerSpec describes a container started by dockerRun
+type ContainerSpec struct {
+	Image  string
+	Cmd    []string
+	Env    *string
+	Labels map[string]string
+	// Network the container is attached to instead of the default bridge
+	Network string
+	// Additional hostnames of the container on the network
+	Aliases []string
+	// Host directory bind mounted to /runner. Optional
+	MountPath string
+	// Docker volume name -> mount path
+	Volumes    map[string]string
+	WorkingDir string
+	Resources  container.Resources
+}
+
+func dockerRun(spec ContainerSpec) (string, error) {
+	var err error
 
 	containerConfig := container.Config{
-		Image: image,
-		Cmd:   cmdParts,
-		Tty:   false,
+		Image:      spec.Image,
+		Cmd:        spec.Cmd,
+		WorkingDir: spec.WorkingDir,
+		Labels:     spec.Labels,
+		Tty:        false,
 	}
 
-	if env != nil {
-		containerConfig.Env = strings.Split(*env, "\n")
+	if spec.Env != nil {
+		containerConfig.Env = strings.Split(*spec.Env, "\n")
 	}
 
-	var mountPathAbs string
+	hostConfig := container.HostConfig{
+		Resources: spec.Resources,
+	}
 
-	// Handle docker in docker mode
-	hostMountPath := os.Getenv("DOCKER_HOST_MOUNT_PATH")
-	if hostMountPath != "" {
-              mountPathAbs = path.Join(hostMountPath, mountPath)
-	} else {
-		mountPathAbs, err = filepath.Abs(mountPath)
-		if err != nil {
-			return "", err
+	if spec.MountPath != "" {
+		var mountPathAbs string
+
+		// Handle docker in docker mode
+		hostMountPath := os.Getenv("DOCKER_HOST_MOUNT_PATH")
+		if hostMountPath != "" {
+			mountPathAbs = path.Join(hostMountPath, spec.MountPath)
+		} else {
+			mountPathAbs, err = filepath.Abs(spec.MountPath)
+			if err != nil {
+				return "", err
 
+			}
 		}
-	}
 
-	hostConfig := container.HostConfig{
-		// Resources: container.Resources{
-		// 	Memory:         1e9, // 1GB RAM
-		// 	NanoCPUs:       1e9, // 1 CPU Core
-		// 	OomKillDisable: ptr(true),
-		// },
-		Mounts: []mount.Mount{
+		hostConfig.Mounts = []mount.Mount{
 			{
 				Type:   mount.TypeBind,
 				Source: mountPathAbs,
 				Target: "/runner",
 			},
-		},
+		}
 	}
 
-	if port != nil && hostPort != nil {
-		containerConfig.ExposedPorts = nat.PortSet{
-			nat.Port(*port): struct{}{},
-		}
-		hostConfig.PortBindings = nat.PortMap{
-			nat.Port(*port): []nat.PortBinding{
-				{
-					HostIP:   "127.0.0.1",
-					HostPort: *hostPort,
-				},
-			},
+	for name, target := range spec.Volumes {
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: name,
+			Target: target,
+		})
+	}
+
+	networkingConfig := network.NetworkingConfig{}
+	if spec.Network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(spec.Network)
+		networkingConfig.EndpointsConfig = map[string]*network.EndpointSettings{
+			spec.Network: {Aliases: spec.Aliases},
 		}
 	}
 
@@ -109,7 +142,7 @@ func dockerRun(
 		context.Background(),
 		&containerConfig,
 		&hostConfig,
-		&network.NetworkingConfig{},
+		&networkingConfig,
 		nil,
 		"",
 	)
@@ -128,6 +161,244 @@ func dockerRun(
 	return resp.ID, nil
 }
 
+type ImagePullError struct {
+	Image string
+	Err   error
+}
+
+func (e *ImagePullError) Error() string {
+	return fmt.Sprintf("Failed to pull image %s: %s", e.Image, e.Err)
+}
+
+func (e *ImagePullError) Unwrap() error {
+	return e.Err
+}
+
+func dockerPull(image string, logs io.Writer) error {
+	fmt.Fprintf(logs, "%s [docker] Pulling image: %s\n", logTimestamp(), image)
+
+	registryAuth, err := getRegistryAuth(image)
+	if err != nil {
+		return &ImagePullError{Image: image, Err: err}
+	}
+
+	reader, err := docker.ImagePull(
+		context.Background(),
+		image,
+		types.ImagePullOptions{RegistryAuth: registryAuth},
+	)
+	if err != nil {
+		return &ImagePullError{Image: image, Err: err}
+	}
+	defer reader.Close()
+
+	err = writeJSONMessages(reader, logs)
+	if err != nil {
+		return &ImagePullError{Image: image, Err: err}
+	}
+
+	return nil
+}
+
+// writeJSONMessages decodes a docker JSON message stream (pull, build) into
+// plain log lines. Progress updates are throttled per layer to keep logs short
+func writeJSONMessages(reader io.Reader, w io.Writer) error {
+	decoder := json.NewDecoder(reader)
+	lastProgress := make(map[string]time.Time)
+
+	for {
+		var msg jsonmessage.JSONMessage
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if msg.ErrorMessage != "" {
+			return errors.New(msg.ErrorMessage)
+		}
+
+		if msg.Stream != "" {
+			fmt.Fprint(w, msg.Stream)
+			continue
+		}
+		if msg.Status == "" {
+			continue
+		}
+
+		line := msg.Status
+		if msg.ID != "" {
+			line = fmt.Sprintf("%s: %s", msg.ID, line)
+		}
+		if msg.Progress != nil && msg.Progress.Total > 0 {
+			if time.Since(lastProgress[msg.ID]) < 2*time.Second {
+				continue
+			}
+			lastProgress[msg.ID] = time.Now()
+
+			line = fmt.Sprintf(
+				"%s %s/%s",
+				line,
+				units.HumanSize(float64(msg.Progress.Current)),
+				units.HumanSize(float64(msg.Progress.Total)),
+			)
+		}
+
+		fmt.Fprintf(w, "%s [docker] %s\n", logTimestamp(), line)
+	}
+}
+
+func isValidPullPolicy(policy string) bool {
+	return policy == PullAlways || policy == PullIfNotPresent || policy == PullNever
+}
+
+// dockerEnsureImage makes the image available locally according to the pull
+// policy and returns its digest. The digest can be used as image reference to
+// run exactly the recorded image
+func dockerEnsureImage(image, policy string, logs io.Writer) (string, error) {
+	if !isValidPullPolicy(policy) {
+		return "", fmt.Errorf("Invalid pull policy: %s", policy)
+	}
+
+	inspect, _, err := docker.ImageInspectWithRaw(context.Background(), image)
+	present := err == nil
+	if err != nil && !client.IsErrNotFound(err) {
+		return "", err
+	}
+
+	switch policy {
+	case PullAlways:
+		err = dockerPull(image, logs)
+	case PullIfNotPresent:
+		if present {
+			fmt.Fprintf(logs, "%s [docker] Using local image: %s\n", logTimestamp(), image)
+		} else {
+			err = dockerPull(image, logs)
+		}
+	case PullNever:
+		if !present {
+			return "", &ImagePullError{
+				Image: image,
+				Err:   errors.New("image is not present locally and pull policy is never"),
+			}
+		}
+		fmt.Fprintf(logs, "%s [docker] Using local image: %s\n", logTimestamp(), image)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !present || policy == PullAlways {
+		inspect, _, err = docker.ImageInspectWithRaw(context.Background(), image)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	digest := imageDigest(inspect)
+	fmt.Fprintf(logs, "%s [docker] Image digest: %s\n", logTimestamp(), digest)
+
+	return digest, nil
+}
+
+// dockerImageDigest resolves a local image reference, e.g. a tag, to the
+// image it currently points at
+func dockerImageDigest(image string) (string, error) {
+	inspect, _, err := docker.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return "", err
+	}
+	return imageDigest(inspect), nil
+}
+
+// imageDigest returns the registry digest of the image, or its id for images
+// that were never pushed or pulled
+func imageDigest(inspect types.ImageInspect) string {
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0]
+	}
+	return inspect.ID
+}
+
+// dockerBuildArtifactImage packages the artifact found in srcDir into a new
+// image layered on top of baseImage. The artifact ends up at /runner/<artifact>
+func dockerBuildArtifactImage(srcDir, artifact, baseImage, tag string, logs io.Writer) error {
+	dockerfile := fmt.Sprintf(
+		"FROM %s\nCOPY [\"%s\", \"/runner/%s\"]\n",
+		baseImage,
+		artifact,
+		artifact,
+	)
+
+	// Stream build context
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBuildContext(writer, srcDir, artifact, dockerfile))
+	}()
+	defer reader.Close()
+
+	resp, err := docker.ImageBuild(
+		context.Background(),
+		reader,
+		types.ImageBuildOptions{
+			Tags:        []string{tag},
+			Dockerfile:  "r_Dockerfile",
+			Remove:      true,
+			ForceRemove: true,
+			Labels: map[string]string{
+				"runner.artifact": "true",
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return writeJSONMessages(resp.Body, logs)
+}
+
+func writeBuildContext(w io.Writer, srcDir, artifact, dockerfile string) error {
+	tw := tar.NewWriter(w)
+
+	err := tw.WriteHeader(&tar.Header{
+		Name: "r_Dockerfile",
+		Mode: 0644,
+		Size: int64(len(dockerfile)),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = tw.Write([]byte(dockerfile)); err != nil {
+		return err
+	}
+
+	err = tarDirectory(tw, srcDir, artifact)
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func dockerTagImage(image, tag string) error {
+	return docker.ImageTag(context.Background(), image, tag)
+}
+
+func dockerRemoveImage(image string) error {
+	_, err := docker.ImageRemove(
+		context.Background(),
+		image,
+		types.ImageRemoveOptions{PruneChildren: true},
+	)
+	return err
+}
+
 func dockerLogs(id string) (string, error) {
 	reader, err := docker.ContainerLogs(
 		context.Background(),
@@ -145,6 +416,108 @@ func dockerLogs(id string) (string, error) {
 	return buf.String(), err
 }
 
+// dockerFollowLogs streams the container output into w until the container
+// stops
+func dockerFollowLogs(id string, w io.Writer) error {
+	reader, err := docker.ContainerLogs(
+		context.Background(),
+		id,
+		types.ContainerLogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Timestamps: true,
+			Follow:     true,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = stdcopy.StdCopy(w, w, reader)
+	return err
+}
+
+// dockerWait blocks until the container stopped and returns its final state
+func dockerWait(id string) (*types.ContainerState, error) {
+	statusChan, errChan := docker.ContainerWait(
+		context.Background(),
+		id,
+		container.WaitConditionNotRunning,
+	)
+	select {
+	case err := <-errChan:
+		return nil, err
+	case <-statusChan:
+	}
+
+	inspect, err := docker.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return inspect.State, nil
+}
+
+// dockerExec runs cmd inside a running container, writes its output into w
+// and returns the exit code
+func dockerExec(id string, cmd []string, w io.Writer) (int, error) {
+	return dockerExecContext(context.Background(), id, cmd, w)
+}
+
+// dockerExecContext is dockerExec, but stops waiting for the command once ctx
+// is done. The command itself is not killed
+func dockerExecContext(ctx context.Context, id string, cmd []string, w io.Writer) (int, error) {
+	createRes, err := docker.ContainerExecCreate(
+		ctx,
+		id,
+		types.ExecConfig{
+			AttachStdout: true,
+			AttachStderr: true,
+			Cmd:          cmd,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	attachRes, err := docker.ContainerExecAttach(
+		ctx,
+		createRes.ID,
+		types.ExecStartCheck{},
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer attachRes.Close()
+
+	// Closing the connection unblocks reading the output
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			attachRes.Close()
+		case <-done:
+		}
+	}()
+
+	_, err = stdcopy.StdCopy(w, w, attachRes.Reader)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	inspect, err := docker.ContainerExecInspect(ctx, createRes.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return inspect.ExitCode, nil
+}
+
 func dockerShell(id string) (*net.Conn, error) {
 	config := types.ExecConfig{
 		AttachStdin:  true,
@@ -176,20 +549,24 @@ func dockerShell(id string) (*net.Conn, error) {
 	return &attachRes.Conn, nil
 }
 
-func dockerWatch() error {
-	// Watch container
-	eChan, errChan := docker.Events(context.Background(), types.EventsOptions{})
+// dockerWatch calls handler for die and oom events of run containers until
+// the event stream fails
+func dockerWatch(handler func(events.Message)) error {
+	eChan, errChan := docker.Events(context.Background(), types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("event", "die"),
+			filters.Arg("event", "oom"),
+			filters.Arg("label", fmt.Sprintf("%s=%s", labelRole, RoleRun)),
+		),
+	})
 
 	for {
 		select {
 		case err := <-errChan:
 			return err
 		case msg := <-eChan:
-			if msg.Type == "container" {
-				if msg.Action == "die" {
-					log.Println("Container died:", msg.Actor.ID)
-				}
-			}
+			handler(msg)
 		}
 	}
 }
@@ -198,7 +575,8 @@ func dockerRemove(id string) error {
 	return docker.ContainerRemove(
 		context.Background(),
 		id,
-		types.ContainerRemoveOptions{},
+		// Anonymous volumes, e.g. of database images, are useless afterwards
+		types.ContainerRemoveOptions{RemoveVolumes: true},
 	)
 }
 
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+var hostnameRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// CustomDomain routes an additional hostname to the production deployment of
+// the app, or to the newest deployment of a branch
+type CustomDomain struct {
+	Domain string `json:"domain"`
+	Branch string `json:"branch"`
+}
+
+// GetProductionDomain returns the domain of the promoted deployment
+func (a *App) GetProductionDomain() string {
+	return fmt.Sprintf("%s.%s", a.GetSlug(), domain)
+}
+
+func (a *App) GetProductionUrl() string {
+	return formatUrl(a.GetProductionDomain())
+}
+
+// isProduction reports whether the deployment was promoted to production
+func (a *App) isProduction(deployment *Deployment) bool {
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
+	return a.ProductionId != nil && *a.ProductionId == deployment.Id
+}
+
+// Promote makes the deployment the production deployment of the app. Only
+// deployments that passed readiness can be promoted
+func (a *App) Promote(deployment *Deployment) error {
+	if status := deployment.GetStatus(); status != StateRunning && status != StateSleeping {
+		return fmt.Errorf("Only running deployments can be promoted, deployment is %s", status)
+	}
+
+	routesLock.Lock()
+	a.ProductionId = ptr(deployment.Id)
+	routesLock.Unlock()
+
+	log.Printf("[Production] %s -> %s", a.GetProductionDomain(), deployment.GetSlug())
+	return nil
+}
+
+// getDomainTarget returns the deployment a custom domain currently routes to
+func (a *App) getDomainTarget(customDomain CustomDomain) *Deployment {
+	if customDomain.Branch != "" {
+		id, ok := a.getAlias(customDomain.Branch)
+		if !ok {
+			return nil
+		}
+		return getDeploymentById(id)
+	}
+
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
+	if a.ProductionId == nil {
+		return nil
+	}
+	return getDeploymentById(*a.ProductionId)
+}
+
+// validateCustomDomain checks that host is a valid hostname that is not used
+// by runner itself or another app. Callers must hold routesLock
+func validateCustomDomain(host string) error {
+	if !hostnameRegex.MatchString(host) {
+		return fmt.Errorf("Invalid domain: %s", host)
+	}
+	if host == domain || strings.HasSuffix(host, "."+domain) {
+		return fmt.Errorf("Subdomains of %s are assigned by runner", domain)
+	}
+	if lookupCustomDomain(host) != nil {
+		return fmt.Errorf("Domain is already in use: %s", host)
+	}
+	return nil
+}
+
+// AddCustomDomain attaches host to the app, routing to the production
+// deployment or the newest deployment of branch
+func (a *App) AddCustomDomain(host, branch string) error {
+	host = normalizeHost(host)
+
+	// Validate and append at once, two requests must not add the same domain
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	err := validateCustomDomain(host)
+	if err != nil {
+		return err
+	}
+
+	a.CustomDomains = append(a.CustomDomains, CustomDomain{Domain: host, Branch: branch})
+	return nil
+}
+
+func (a *App) RemoveCustomDomain(host string) error {
+	host = normalizeHost(host)
+
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	_, found := lo.Find(a.CustomDomains, func(d CustomDomain) bool {
+		return d.Domain == host
+	})
+	if !found {
+		return errors.New("Unknown domain")
+	}
+
+	a.CustomDomains = lo.Filter(a.CustomDomains, func(d CustomDomain, _ int) bool {
+		return d.Domain != host
+	})
+	return nil
+}
+
+type customDomainMatch struct {
+	app          *App
+	customDomain CustomDomain
+}
+
+// normalizeHost lowercases host and strips the trailing dot of fully
+// qualified names, matching how custom domains are stored
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func findCustomDomain(host string) *customDomainMatch {
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
+	return lookupCustomDomain(host)
+}
+
+// lookupCustomDomain is findCustomDomain for callers holding routesLock
+func lookupCustomDomain(host string) *customDomainMatch {
+	for _, app := range apps {
+		for _, customDomain := range app.CustomDomains {
+			if customDomain.Domain == host {
+				return &customDomainMatch{app: app, customDomain: customDomain}
+			}
+		}
+	}
+
+	return nil
+}
+
+// isCustomDomain reports whether certificates may be issued for host
+func isCustomDomain(host string) bool {
+	return findCustomDomain(host) != nil
+}
+
+// getDeploymentByAppDomain resolves production and custom domains
+func getDeploymentByAppDomain(host string) *Deployment {
+	if match := findCustomDomain(host); match != nil {
+		return match.app.getDomainTarget(match.customDomain)
+	}
+
+	for _, app := range apps {
+		if app.GetProductionDomain() == host {
+			return app.getDomainTarget(CustomDomain{})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestValidateCustomDomain(t *testing.T) {
+	withRoutingFixture(t, []*App{
+		{Name: "app", CustomDomains: []CustomDomain{{Domain: "taken.example.org"}}},
+	})
+
+	tests := []struct {
+		host    string
+		wantErr bool
+	}{
+		{"example.org", false},
+		{"www.example.org", false},
+		{"a-b.example.co.uk", false},
+		{"taken.example.org", true},
+		{"example.com", true},
+		{"app.example.com", true},
+		{"localhost", true},
+		{"-bad.example.org", true},
+		{"UPPER.example.org", true},
+		{"under_score.example.org", true},
+	}
+
+	for _, test := range tests {
+		err := validateCustomDomain(test.host)
+		if (err != nil) != test.wantErr {
+			t.Errorf("validateCustomDomain(%q) = %v, want error: %v", test.host, err, test.wantErr)
+		}
+	}
+}
+
+func TestPromote(t *testing.T) {
+	tests := []struct {
+		status  DeploymentState
+		wantErr bool
+	}{
+		{StateRunning, false},
+		{StateSleeping, false},
+		{StateStopped, true},
+		{StateBuilding, true},
+		{StateFailed, true},
+	}
+
+	for _, test := range tests {
+		deployment := &Deployment{
+			Id:        "deployment",
+			GitBranch: "main",
+			GitCommit: "0123456789abcdef",
+			Status:    test.status,
+			StateLock: &sync.Mutex{},
+		}
+		app := &App{Name: "app", Deployments: []*Deployment{deployment}}
+		withRoutingFixture(t, []*App{app})
+
+		err := app.Promote(deployment)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Promote(%s) = %v, want error: %v", test.status, err, test.wantErr)
+		}
+		if app.isProduction(deployment) == test.wantErr {
+			t.Errorf("Promote(%s): isProduction = %v", test.status, !test.wantErr)
+		}
+	}
+}
+
+func TestAddCustomDomain(t *testing.T) {
+	app := &App{Name: "app"}
+	other := &App{Name: "other"}
+	withRoutingFixture(t, []*App{app, other})
+
+	// Concurrent requests for the same domain, only one may add it
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(a *App) {
+			defer wg.Done()
+			errs <- a.AddCustomDomain("WWW.example.org.", "")
+		}([]*App{app, other}[i%2])
+	}
+	wg.Wait()
+	close(errs)
+
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+		}
+	}
+	if total := len(app.CustomDomains) + len(other.CustomDomains); added != 1 || total != 1 {
+		t.Fatalf("added %d times, %d custom domains, want 1", added, total)
+	}
+
+	owner := app
+	if len(other.CustomDomains) == 1 {
+		owner = other
+	}
+	if got := owner.CustomDomains[0].Domain; got != "www.example.org" {
+		t.Errorf("stored domain = %q, want www.example.org", got)
+	}
+	if err := owner.RemoveCustomDomain("www.EXAMPLE.org."); err != nil {
+		t.Errorf("RemoveCustomDomain() = %v", err)
+	}
+	if len(owner.CustomDomains) != 0 {
+		t.Errorf("custom domains = %v, want none", owner.CustomDomains)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every template can ship a small example repository in
+// ./templates/fixtures/<template id>. Fixtures are built and started without
+// cloning, so templates can be tested offline once their images are present
+const fixturesDir = "./templates/fixtures"
+
+// testTemplateFixtures tests the fixtures of the given templates, or all
+// fixtures if ids is empty
+func testTemplateFixtures(ids []string) error {
+	if len(ids) == 0 {
+		entries, err := os.ReadDir(fixturesDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				ids = append(ids, entry.Name())
+			}
+		}
+	}
+
+	var failed []string
+	for _, id := range ids {
+		log.Println("[Fixture] Testing template:", id)
+
+		err := testTemplateFixture(id)
+		if err != nil {
+			log.Printf("[Fixture] %s: FAIL: %s", id, err)
+			failed = append(failed, id)
+			continue
+		}
+
+		log.Printf("[Fixture] %s: OK", id)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed templates: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func testTemplateFixture(id string) (err error) {
+	fixturePath := path.Join(fixturesDir, id)
+	if _, err = os.Stat(fixturePath); err != nil {
+		return err
+	}
+
+	if _, ok := getTemplate(id); !ok {
+		return fmt.Errorf("Unknown template: %s", id)
+	}
+
+	// Detection
+	detected, err := suggestBuildTemplate(fixturePath)
+	if err != nil {
+		return err
+	}
+	if detected != id {
+		return fmt.Errorf("Fixture was detected as template: %s", detected)
+	}
+
+	// Build and run
+	app := &App{
+		Id:             makeId(),
+		Name:           fmt.Sprintf("fixture %s", id),
+		TemplateId:     ptr(id),
+		PackageManager: "npm",
+	}
+	deployment := &Deployment{
+		Id:              makeId(),
+		Time:            time.Now(),
+		App:             app,
+		GitBranch:       "fixture",
+		GitCommit:       strings.Repeat("0", 40),
+		RequestsLogLock: &sync.Mutex{},
+		StateLock:       &sync.Mutex{},
+	}
+	deployment.recordState(StatePending, "Template fixture")
+	deployment.BuildJob = &BuildJob{
+		Id:         makeId(),
+		Deployment: deployment,
+		Status:     BuildRunning,
+		SourcePath: fixturePath,
+	}
+	app.Deployments = []*Deployment{deployment}
+
+	defer func() {
+		if err != nil {
+			logs, _ := deployment.BuildJob.GetLogs()
+			fmt.Println(logs)
+		}
+		deployment.Destroy()
+		app.removeNetwork()
+	}()
+
+	err = deployment.BuildJob.Run()
+	if err != nil {
+		return err
+	}
+
+	err = deployment.Run()
+	if err != nil {
+		return err
+	}
+
+	template, err := deployment.getTemplate()
+	if err != nil {
+		return err
+	}
+	if template.Run.IsStatic() {
+		return testStaticDeployment(deployment, template)
+	}
+
+	return waitForHttp(fmt.Sprintf("http://%s/", deployment.getAddress()), time.Minute)
+}
+
+// testStaticDeployment requests the index page without starting the server
+func testStaticDeployment(deployment *Deployment, template TemplateConfig) error {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		return deployment.ServeStatic(c, template)
+	})
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/", nil))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != fiber.StatusOK {
+		return fmt.Errorf("Status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func waitForHttp(url string, timeout time.Duration) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(timeout)
+
+	var lastErr error
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				return nil
+			}
+			err = fmt.Errorf("Status code: %d", resp.StatusCode)
+		}
+		lastErr = err
+
+		time.Sleep(time.Second)
+	}
+
+	return errors.Join(errors.New("Deployment did not respond in time"), lastErr)
+}
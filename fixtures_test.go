@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withTemplates replaces the loaded templates for the duration of the test
+func withTemplates(t *testing.T, templates map[string]TemplateConfig) {
+	templatesLock.Lock()
+	previous := deploymentTemplates
+	deploymentTemplates = templates
+	templatesLock.Unlock()
+
+	t.Cleanup(func() {
+		templatesLock.Lock()
+		deploymentTemplates = previous
+		templatesLock.Unlock()
+	})
+}
+
+func TestSuggestBuildTemplateFixtures(t *testing.T) {
+	withTemplates(t, nil)
+	loadTemplates()
+	if errs := getTemplateErrors(); len(errs) > 0 {
+		t.Fatalf("templates failed to load: %v", errs)
+	}
+
+	entries, err := os.ReadDir(fixturesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id := entry.Name()
+
+		if _, ok := getTemplate(id); !ok {
+			t.Errorf("fixture %s has no template", id)
+			continue
+		}
+		got, err := suggestBuildTemplate(filepath.Join(fixturesDir, id))
+		if err != nil || got != id {
+			t.Errorf("suggestBuildTemplate(%s) = %q, %v", id, got, err)
+		}
+	}
+}
+
+func TestFindTemplateByFiles(t *testing.T) {
+	withTemplates(t, map[string]TemplateConfig{
+		"static": {MatchFiles: []string{"index.html"}, Priority: -10},
+		"go":     {MatchFiles: []string{"go.mod"}},
+		"hugo":   {MatchFiles: []string{"hugo.toml", "config.toml"}, Priority: 10},
+		// Same priority, ordered by id
+		"bun":  {MatchFiles: []string{"bun.lockb"}},
+		"deno": {MatchFiles: []string{"bun.lockb", "deno.json"}},
+	})
+
+	tests := []struct {
+		files []string
+		want  string
+	}{
+		{[]string{"index.html"}, "static"},
+		{[]string{"index.html", "go.mod"}, "go"},
+		{[]string{"index.html", "go.mod", "config.toml"}, "hugo"},
+		{[]string{"bun.lockb", "deno.json"}, "bun"},
+		{[]string{"deno.json"}, "deno"},
+		{[]string{"README.md"}, ""},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		for _, file := range test.files {
+			if err := os.WriteFile(filepath.Join(dir, file), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := findTemplateByFiles(dir)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("findTemplateByFiles(%v) = %q, want error", test.files, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("findTemplateByFiles(%v) = %q, %v, want %q", test.files, got, err, test.want)
+		}
+	}
+}
+
+func TestSuggestBuildTemplate(t *testing.T) {
+	withTemplates(t, map[string]TemplateConfig{
+		"static": {MatchFiles: []string{"index.html"}, Priority: -10},
+		"nextjs": {MatchDependencies: []string{"next"}},
+		"vite":   {MatchDependencies: []string{"vite"}},
+		"remix":  {MatchDependencies: []string{"@remix-run/node"}, Priority: 5},
+	})
+
+	tests := []struct {
+		name        string
+		packageJSON string
+		want        string
+		wantErr     bool
+	}{
+		{"dependencies", `{"dependencies": {"next": "14.0.0"}}`, "nextjs", false},
+		{"dev dependencies", `{"devDependencies": {"vite": "5.0.0"}}`, "vite", false},
+		{"priority", `{"dependencies": {"next": "14.0.0", "@remix-run/node": "2.0.0"}}`, "remix", false},
+		{"falls back to files", `{"dependencies": {"express": "4.0.0"}}`, "static", false},
+		{"no package.json", "", "static", false},
+		{"invalid dependencies", `{"dependencies": {"next": 14}}`, "", true},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "index.html"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.packageJSON != "" {
+			err := os.WriteFile(filepath.Join(dir, "package.json"), []byte(test.packageJSON), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := suggestBuildTemplate(dir)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%s: suggestBuildTemplate() = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestViteBuildScript(t *testing.T) {
+	withTemplates(t, nil)
+	loadTemplates()
+	template, ok := getTemplate("vite")
+	if !ok {
+		t.Fatal("vite template not found")
+	}
+
+	// npm must not go through corepack, it would be downloaded
+	tests := map[string]string{
+		"":     "npm install",
+		"npm":  "npm install",
+		"pnpm": "corepack pnpm install",
+		"yarn": "corepack yarn install",
+	}
+	for pm, want := range tests {
+		script, err := renderScript("build", template.Build.Script, ScriptContext{PackageManager: pm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first := strings.Split(strings.TrimSpace(script), "\n")[0]; first != want {
+			t.Errorf("package manager %q: first line = %q, want %q", pm, first, want)
+		}
+	}
+}
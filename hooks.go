@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrHookFailed = errors.New("Hook failed")
+
+// Hooks are scripts that run in the built environment. Pre deploy hooks run
+// in a one-off container before the run container is started, post deploy
+// hooks run inside the run container once it passed the readiness probe
+type Hooks struct {
+	PreDeploy  string `toml:"pre_deploy"  json:"pre_deploy"`
+	PostDeploy string `toml:"post_deploy" json:"post_deploy"`
+}
+
+// Merge returns h with all hooks that are set in override replaced
+func (h Hooks) Merge(override *Hooks) Hooks {
+	if override == nil {
+		return h
+	}
+
+	if override.PreDeploy != "" {
+		h.PreDeploy = override.PreDeploy
+	}
+	if override.PostDeploy != "" {
+		h.PostDeploy = override.PostDeploy
+	}
+
+	return h
+}
+
+func (d *Deployment) getHooks() Hooks {
+	// Missing templates are reported by the build
+	template, _ := d.getTemplate()
+	return template.Hooks.Merge(d.App.Hooks)
+}
+
+func (d *Deployment) openHooksLog() (*LogFile, error) {
+	d.HooksLogPath = getLogPath(d.Id, "hooks")
+	return openLogFile(d.HooksLogPath)
+}
+
+// RunPreDeployHook runs the pre deploy hook (e.g. migrations) in a one-off
+// container of the built environment. Does nothing if no hook is configured
+func (d *Deployment) RunPreDeployHook() (err error) {
+	hooks := d.getHooks()
+	if hooks.PreDeploy == "" {
+		return nil
+	}
+
+	// Only built deployments can run hooks
+	err = d.SetState(StateRunningHooks, "Pre deploy hook")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			d.SetState(failureState(err, StateHookFailed), err.Error())
+			writeConfig()
+		}
+	}()
+
+	hooksLog, err := d.openHooksLog()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			hooksLog.Printf("Pre deploy hook failed: %s", err)
+		} else {
+			hooksLog.Printf("Pre deploy hook finished")
+		}
+		hooksLog.Close()
+	}()
+
+	template, err := d.getTemplate()
+	if err != nil {
+		return
+	}
+
+	spec, err := d.prepareContainer(template, hooks.PreDeploy, "r_pre_deploy.sh", RoleHook, hooksLog)
+	if err != nil {
+		return
+	}
+	if spec.MountPath != "" {
+		defer os.RemoveAll(spec.MountPath)
+	}
+
+	hooksLog.Printf("Running pre deploy hook using image: %s", spec.Image)
+	containerId, err := dockerRun(spec)
+	if err != nil {
+		return
+	}
+	defer dockerRemove(containerId)
+
+	err = dockerFollowLogs(containerId, hooksLog)
+	if err != nil {
+		return
+	}
+
+	state, err := dockerWait(containerId)
+	if err != nil {
+		return
+	}
+	if state.OOMKilled {
+		return ErrOOMKilled
+	}
+	if state.ExitCode != 0 {
+		return fmt.Errorf("%w: pre deploy exited with code %d", ErrHookFailed, state.ExitCode)
+	}
+
+	return nil
+}
+
+// RunPostDeployHook runs the post deploy hook (e.g. seeding) inside the
+// started run container. Does nothing if no hook is configured
+func (d *Deployment) RunPostDeployHook() (err error) {
+	hooks := d.getHooks()
+	if hooks.PostDeploy == "" {
+		return nil
+	}
+
+	hooksLog, err := d.openHooksLog()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			hooksLog.Printf("Post deploy hook failed: %s", err)
+		} else {
+			hooksLog.Printf("Post deploy hook finished")
+		}
+		hooksLog.Close()
+	}()
+
+	template, err := d.getTemplate()
+	if err != nil {
+		return
+	}
+
+	script, err := renderScript("hooks.post_deploy", hooks.PostDeploy, newScriptContext(d, template))
+	if err != nil {
+		return
+	}
+	script = fmt.Sprintf("cd /runner/\n\n%s", script)
+
+	hooksLog.Printf("Running post deploy hook")
+	exitCode, err := dockerExec(*d.ContainerId, []string{"/bin/sh", "-c", script}, hooksLog)
+	if err != nil {
+		return
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%w: post deploy exited with code %d", ErrHookFailed, exitCode)
+	}
+
+	return nil
+}
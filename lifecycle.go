@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	cp "github.com/otiai10/copy"
+)
+
+// Stop stops the run container. Stopped deployments are not routed until they
+// are started again. If the container can not be stopped, the deployment fails
+func (d *Deployment) Stop() error {
+	// Set state first, so the crash watcher ignores the stopped container
+	err := d.SetState(StateStopped, "Stopped")
+	if err != nil {
+		return err
+	}
+	writeConfig()
+
+	// Static deployments have no container
+	if d.ContainerId == nil {
+		return nil
+	}
+	err = dockerStop(*d.ContainerId)
+	d.StopServices()
+	if err != nil {
+		// The container may still be running, but is no longer routed
+		d.SetState(StateFailed, fmt.Sprintf("Stop failed: %s", err))
+		writeConfig()
+	}
+	return err
+}
+
+// Start starts the existing run container of a stopped, sleeping or crashed
+// deployment and waits for the readiness probe
+func (d *Deployment) Start(reason string) error {
+	return d.start(nil, reason)
+}
+
+// start is Start, but only starts deployments that are in one of the states in
+// from (any state that can be started if from is empty)
+func (d *Deployment) start(from []DeploymentState, reason string) (err error) {
+	_, err = d.swapState(from, StateStarting, reason)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			// Crashed again while starting, continue with the restart policy
+			if d.ContainerId != nil {
+				running, exitCode, oomKilled, inspectErr := inspectExit(*d.ContainerId)
+				if inspectErr == nil && !running {
+					d.handleCrash(exitCode, oomKilled)
+					return
+				}
+			}
+			d.SetState(failureState(err, StateFailed), err.Error())
+		} else {
+			d.SetState(StateRunning, "")
+		}
+
+		writeConfig()
+	}()
+
+	buildLog, err := d.openBuildLog()
+	if err != nil {
+		return
+	}
+	defer buildLog.Close()
+
+	template, err := d.getTemplate()
+	if err != nil {
+		return
+	}
+
+	if template.Run.IsStatic() {
+		buildLog.Printf("Serving static files from %s", template.Build.Artifact)
+		return
+	}
+	if d.ContainerId == nil {
+		return errors.New("Deployment has no container")
+	}
+
+	// Services were stopped with the deployment
+	err = d.StartServices(template, buildLog)
+	if err != nil {
+		return
+	}
+
+	buildLog.Printf("Starting container (%s)", reason)
+	err = dockerStart(*d.ContainerId)
+	if err != nil {
+		return
+	}
+
+	// The container gets a new address on every start
+	err = d.updateAddress(template)
+	if err != nil {
+		return
+	}
+
+	return d.waitReady(template, buildLog)
+}
+
+// Restart stops the run container if needed and starts it again
+func (d *Deployment) Restart() error {
+	if canTransition(d.GetStatus(), StateStopped) {
+		err := d.Stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.Start("Restart")
+}
+
+// Redeploy creates a new deployment of the same commit. The artifact of the
+// source deployment can be reused to skip the build. env replaces the env of
+// the source deployment if set
+func (a *App) Redeploy(source *Deployment, reuseArtifact bool, env *string) (*Deployment, error) {
+	deployment := a.newDeployment(source.GitBranch, source.GitCommit)
+	deployment.Env = source.Env
+	if env != nil {
+		deployment.Env = env
+	}
+
+	if reuseArtifact {
+		err := deployment.reuseArtifact(source)
+		if err != nil {
+			deployment.Destroy()
+			return nil, err
+		}
+	}
+
+	a.addDeployment(deployment)
+	writeConfig()
+
+	go a.runDeployment(deployment, !reuseArtifact)
+
+	return deployment, nil
+}
+
+// reuseArtifact copies the artifact and effective config of a successful
+// build of source instead of building again
+func (d *Deployment) reuseArtifact(source *Deployment) error {
+	if source.BuildJob == nil || source.BuildJob.Status != BuildSuccess || source.Config == nil {
+		return errors.New("Deployment has no artifact to reuse")
+	}
+
+	config := *source.Config
+	d.Config = &config
+	d.BuildJob.ImageDigest = source.BuildJob.ImageDigest
+
+	if source.BuildJob.ArtifactImage != "" {
+		tag := fmt.Sprintf("runner-artifact:%s", d.Id)
+		err := dockerTagImage(source.BuildJob.ArtifactImage, tag)
+		if err != nil {
+			return err
+		}
+		d.BuildJob.ArtifactImage = tag
+	} else {
+		artifactDir, err := os.MkdirTemp("./artifacts", "")
+		if err != nil {
+			return err
+		}
+		d.BuildJob.ArtifactsPath = artifactDir
+
+		err = cp.Copy(source.BuildJob.ArtifactsPath, artifactDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	buildLog, err := d.openBuildLog()
+	if err != nil {
+		return err
+	}
+	buildLog.Printf("Reusing artifact of deployment %s", source.GetName())
+	buildLog.Close()
+
+	d.BuildJob.Status = BuildSuccess
+	return d.SetState(StateBuilt, fmt.Sprintf("Reusing artifact of %s", source.Id))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Log files are stored as ./logs/<deployment id>/<name>.log so they outlive
+// the containers that produced them
+const logsDir = "./logs"
+
+type LogFile struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+func getLogPath(deploymentId, name string) string {
+	return path.Join(logsDir, deploymentId, fmt.Sprintf("%s.log", name))
+}
+
+func openLogFile(logPath string) (*LogFile, error) {
+	err := os.MkdirAll(filepath.Dir(logPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LogFile{file: file}, nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.file.Write(p)
+}
+
+// Printf writes a runner side log line. Lines are timestamped the same way
+// docker timestamps container output, so both can be read side by side
+func (l *LogFile) Printf(format string, v ...any) {
+	fmt.Fprintf(l, "%s [runner] %s\n", logTimestamp(), fmt.Sprintf(format, v...))
+}
+
+func (l *LogFile) Close() error {
+	return l.file.Close()
+}
+
+func logTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+func readLogFile(logPath string) (string, error) {
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func removeLogs(deploymentId string) error {
+	return os.RemoveAll(path.Join(logsDir, deploymentId))
+}
+
+// cleanupLogs removes the logs of deployments that have not been written to
+// for longer than maxAge
+func cleanupLogs(maxAge time.Duration) {
+	entries, err := os.ReadDir(logsDir)
+	if err != nil {
+		log.Println("[Logs]", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		files, err := os.ReadDir(path.Join(logsDir, entry.Name()))
+		if err != nil {
+			log.Println("[Logs]", err)
+			continue
+		}
+
+		// Use the newest file in the directory
+		var lastWrite time.Time
+		for _, file := range files {
+			info, err := file.Info()
+			if err != nil {
+				continue
+			}
+			if info.ModTime().After(lastWrite) {
+				lastWrite = info.ModTime()
+			}
+		}
+
+		if time.Since(lastWrite) < maxAge {
+			continue
+		}
+
+		log.Println("[Logs] Removing expired logs for deployment:", entry.Name())
+		if err := removeLogs(entry.Name()); err != nil {
+			log.Println("[Logs]", err)
+		}
+	}
+}
+
+func watchLogRetention(maxAge time.Duration) {
+	for {
+		cleanupLogs(maxAge)
+		time.Sleep(time.Hour)
+	}
+}
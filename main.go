@@ -14,8 +14,8 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-playground/webhooks/v6/github"
 	"github.com/go-playground/webhooks/v6/gitlab"
 	"github.com/gofiber/fiber/v2"
@@ -27,26 +27,90 @@ import (
 )
 
 type TemplateConfig struct {
-	Name              string    `toml:"name"               json:"name"`
-	MatchDependencies []string  `toml:"match_dependencies" json:"match_dependencies"`
-	Info              string    `toml:"info"               json:"info"`
-	Build             StepBuild `toml:"build"              json:"build"`
-	Run               StepRun   `toml:"run"                json:"run"`
+	Extends           string             `toml:"extends"            json:"extends"`
+	Name              string             `toml:"name"               json:"name"`
+	MatchDependencies []string           `toml:"match_dependencies" json:"match_dependencies"`
+	MatchFiles        []string           `toml:"match_files"        json:"match_files"`
+	Priority          int                `toml:"priority"           json:"priority"`
+	Info              string             `toml:"info"               json:"info"`
+	Build             StepBuild          `toml:"build"              json:"build"`
+	Run               StepRun            `toml:"run"                json:"run"`
+	Env               map[string]string  `toml:"env"                json:"env"`
+	Resources         ResourceLimits     `toml:"resources"          json:"resources"`
+	Hooks             Hooks              `toml:"hooks"              json:"hooks"`
+	Services          map[string]Service `toml:"services"           json:"services"`
 }
 
 type DeployStep struct {
-	Image  string `toml:"image"  json:"image"`
-	Script string `toml:"script" json:"script"`
+	Image      string `toml:"image"       json:"image"`
+	Script     string `toml:"script"      json:"script"`
+	PullPolicy string `toml:"pull_policy" json:"pull_policy"`
+}
+
+// GetPullPolicy returns the pull policy of the step, falling back to the
+// global -pull-policy flag
+func (s DeployStep) GetPullPolicy() string {
+	if s.PullPolicy != "" {
+		return s.PullPolicy
+	}
+	return pullPolicy
 }
 
 type StepBuild struct {
 	DeployStep
 	Artifact string `toml:"artifact"`
+	// How the artifact is stored: "directory" or "image"
+	Package string `toml:"package" json:"package"`
+}
+
+// Artifact packaging modes
+const (
+	PackageDirectory = "directory"
+	PackageImage     = "image"
+)
+
+// GetPackage returns the artifact packaging mode, falling back to the global
+// -artifact-images flag
+func (s StepBuild) GetPackage() string {
+	if s.Package != "" {
+		return s.Package
+	}
+	if artifactImages {
+		return PackageImage
+	}
+	return PackageDirectory
 }
 
 type StepRun struct {
 	DeployStep
 	Port string `toml:"port"`
+	// "container" (default) or "static"
+	Mode string `toml:"mode" json:"mode"`
+	// Static mode: serve index.html for unknown paths
+	Spa bool `toml:"spa" json:"spa"`
+	// Static mode: page served with status 404, relative to the artifact
+	NotFound string `toml:"not_found" json:"not_found"`
+	// Static mode: Cache-Control header of assets. HTML is never cached
+	CacheControl string `toml:"cache_control" json:"cache_control"`
+	// Container mode: checked before the deployment becomes routable
+	Readiness Probe `toml:"readiness" json:"readiness"`
+	// Container mode: applied when the run container crashes
+	Restart RestartPolicy `toml:"restart" json:"restart"`
+	// Container mode: stop the container after this long without requests.
+	// Overrides -idle-timeout, "0" disables it
+	IdleTimeout string `toml:"idle_timeout" json:"idle_timeout"`
+}
+
+// Run modes
+const (
+	RunContainer = "container"
+	RunStatic    = "static"
+)
+
+// IsStatic reports whether the artifact is served by the runner itself
+// instead of a run container
+func (s StepRun) IsStatic() bool {
+	return s.Mode == RunStatic
 }
 
 // Globals
@@ -59,8 +123,22 @@ var ssl bool
 var debug bool
 var port string
 var sslPort string
+var logRetention time.Duration
+var idleTimeout time.Duration
+var pullPolicy string
+var registryConfig string
+var artifactImages bool
+var volumeHelperImage string
+
+// Set once apps.json was loaded. Subcommands never load it, so they can not
+// overwrite it
+var configLoaded bool
 
 func writeConfig() {
+	if !configLoaded {
+		return
+	}
+
 	data, err := json.MarshalIndent(apps, "", "  ")
 	if err != nil {
 		log.Fatal(err)
@@ -72,6 +150,25 @@ func writeConfig() {
 	}
 }
 
+// Create required tmp folder structure
+func createDataDirs() {
+	if err := createDirIfNotExists("./mounts"); err != nil {
+		log.Fatal(err)
+	}
+	if err := createDirIfNotExists("./mounts/build"); err != nil {
+		log.Fatal(err)
+	}
+	if err := createDirIfNotExists("./mounts/running"); err != nil {
+		log.Fatal(err)
+	}
+	if err := createDirIfNotExists("./artifacts"); err != nil {
+		log.Fatal(err)
+	}
+	if err := createDirIfNotExists(logsDir); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
 	// Save config on exit
 	defer func() {
@@ -84,8 +181,56 @@ func main() {
 	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
 	flag.StringVar(&port, "port", "80", "Port for HTTP")
 	flag.StringVar(&sslPort, "ssl-port", "443", "Port for HTTPS")
+	flag.DurationVar(&logRetention, "log-retention", 30*24*time.Hour, "How long to keep deployment logs (0 keeps them forever)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Stop run containers of deployments without requests for this long (0 disables it)")
+	flag.StringVar(&pullPolicy, "pull-policy", PullAlways, "Default image pull policy: always, if-not-present or never")
+	flag.BoolVar(&artifactImages, "artifact-images", false, "Package build artifacts as docker images instead of directories")
+	flag.StringVar(&registryConfig, "registry-config", "", "Import registry credentials from a docker config.json")
+	flag.StringVar(&volumeHelperImage, "volume-helper-image", "alpine:3", "Image used to copy and snapshot volumes")
 	flag.Parse()
 
+	if !isValidPullPolicy(pullPolicy) {
+		log.Fatal("-pull-policy must be one of: always, if-not-present, never")
+	}
+
+	// Load registry credentials
+	loadSecretKey()
+	loadRegistries()
+	if registryConfig != "" {
+		data, err := os.ReadFile(registryConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hosts, err := importDockerConfig(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeRegistries()
+		log.Println("[Registry] Imported credentials for:", strings.Join(hosts, ", "))
+	}
+
+	// Subcommands
+	switch flag.Arg(0) {
+	case "pull-images":
+		loadTemplates()
+		connectDocker()
+		if err := pullTemplateImages(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "test-templates":
+		loadTemplates()
+		connectDocker()
+		createDataDirs()
+		if err := testTemplateFixtures(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "":
+	default:
+		log.Fatal("Unknown command: ", flag.Arg(0))
+	}
+
 	if domain == "" {
 		log.Fatal("-domain is required")
 	}
@@ -101,12 +246,15 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+	configLoaded = true
 
 	// Recreate pointer references for app and deployment
 	for _, app := range apps {
 		for _, deployment := range app.Deployments {
 			deployment.App = app
 			deployment.RequestsLogLock = &sync.Mutex{}
+			deployment.StateLock = &sync.Mutex{}
+			deployment.restoreState()
 			if deployment.BuildJob != nil {
 				deployment.BuildJob.Deployment = deployment
 			}
@@ -115,22 +263,20 @@ func main() {
 
 	// Init
 	loadTemplates()
+	go watchTemplates()
 	connectDocker()
 
-	// Create required tmp folder structure
-	if err := createDirIfNotExists("./mounts"); err != nil {
-		log.Fatal(err)
-	}
-	if err := createDirIfNotExists("./mounts/build"); err != nil {
-		log.Fatal(err)
-	}
-	if err := createDirIfNotExists("./mounts/running"); err != nil {
-		log.Fatal(err)
-	}
-	if err := createDirIfNotExists("./artifacts"); err != nil {
-		log.Fatal(err)
+	createDataDirs()
+
+	if logRetention > 0 {
+		go watchLogRetention(logRetention)
 	}
 
+	go watchContainers()
+	resumeRestarts()
+	go watchIdleDeployments()
+	go watchRetention()
+
 	// Initialize web server
 	proxy.WithClient(&fasthttp.Client{
 		NoDefaultUserAgentHeader: true,
@@ -145,7 +291,7 @@ func main() {
 
 	app.Get("/runner/api/info", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
-			"templates": deploymentTemplates,
+			"templates": getTemplates(),
 			// Unused for now:
 			"domain":  domain,
 			"ssl":     ssl,
@@ -155,6 +301,133 @@ func main() {
 		})
 	})
 
+	app.Get("/runner/api/template", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"templates": getTemplates(),
+			"errors":    getTemplateErrors(),
+		})
+	})
+
+	app.Get("/runner/api/template/:id", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if !templateIdRegex.MatchString(id) {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid template id")
+		}
+
+		source, err := os.ReadFile(getTemplatePath(id))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown template id")
+		}
+
+		template, _ := getTemplate(id)
+
+		return c.JSON(fiber.Map{
+			"id":       id,
+			"template": template,
+			"source":   string(source),
+			"error":    getTemplateErrors()[id],
+		})
+	})
+
+	app.Post("/runner/api/template/validate", func(c *fiber.Ctx) error {
+		var body struct {
+			// Optional, used to resolve extends of an existing template
+			Id     string `json:"id"`
+			Source string `json:"source"`
+		}
+
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		template, err := parseTemplate(body.Id, []byte(body.Source))
+		if err != nil {
+			return c.JSON(fiber.Map{
+				"valid": false,
+				"error": err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"valid":    true,
+			"template": template,
+		})
+	})
+
+	app.Post("/runner/api/template", func(c *fiber.Ctx) error {
+		var body struct {
+			Id     string `json:"id"`
+			Source string `json:"source"`
+		}
+
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if body.Id == "" || body.Source == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Missing required fields")
+		}
+
+		if _, err := os.Stat(getTemplatePath(body.Id)); err == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Template already exists")
+		}
+
+		if err := saveTemplate(body.Id, []byte(body.Source)); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Put("/runner/api/template/:id", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if !templateIdRegex.MatchString(id) {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid template id")
+		}
+
+		var body struct {
+			Source string `json:"source"`
+		}
+
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if _, err := os.Stat(getTemplatePath(id)); os.IsNotExist(err) {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown template id")
+		}
+
+		if err := saveTemplate(id, []byte(body.Source)); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Delete("/runner/api/template/:id", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if !templateIdRegex.MatchString(id) {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid template id")
+		}
+
+		// Templates that fail to load can be deleted as well
+		if _, err := os.Stat(getTemplatePath(id)); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown template id")
+		}
+
+		if err := deleteTemplate(id); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
 	app.Get("/runner/api/app", func(c *fiber.Ctx) error {
 		return c.JSON(apps)
 	})
@@ -192,6 +465,10 @@ func main() {
 			return fiber.NewError(fiber.StatusBadRequest, "Missing required fields")
 		}
 
+		if _, ok := getTemplate(body.TemplateId); !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown template id")
+		}
+
 		app := App{
 			Id:             makeId(),
 			Name:           body.Name,
@@ -208,7 +485,7 @@ func main() {
 
 		writeConfig()
 
-		return c.JSON(app)
+		return c.JSON(&app)
 	})
 
 	app.Post("/runner/api/app/:id/env", func(c *fiber.Ctx) error {
@@ -243,7 +520,7 @@ func main() {
 		})
 	})
 
-	app.Delete("/runner/api/app/:id", func(c *fiber.Ctx) error {
+	app.Post("/runner/api/app/:id/resources", func(c *fiber.Ctx) error {
 		id := c.Params("id", "")
 		if id == "" {
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
@@ -254,140 +531,139 @@ func main() {
 			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
 		}
 
-		// Delete app
-		apps = lo.Filter(apps, func(a *App, i int) bool {
-			return a.Id != id
-		})
+		// Empty body removes the overrides
+		var body *ResourceLimits
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
 
-		// Delete deployments
-		for _, deployment := range app.Deployments {
-			if deployment.ContainerId != nil {
-				dockerStop(*deployment.ContainerId)
-				dockerRemove(*deployment.ContainerId)
+		if body != nil {
+			if _, err := body.ToDocker(); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
 			}
 		}
 
+		app.Resources = body
+
 		writeConfig()
 
 		return c.JSON(fiber.Map{
 			"success": true,
 		})
-
 	})
 
-	app.Post("/runner/api/app/:id/deploy", func(c *fiber.Ctx) error {
+	app.Post("/runner/api/app/:id/hooks", func(c *fiber.Ctx) error {
 		id := c.Params("id", "")
 		if id == "" {
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
 		}
 
-		var body struct {
-			Branch string `json:"branch"`
-			Commit string `json:"commit"`
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
 		}
 
-		if err := c.BodyParser(&body); err != nil {
-			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		// Empty body removes the overrides
+		var body *Hooks
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
 		}
 
-		if body.Branch == "" || body.Commit == "" {
-			return fiber.NewError(fiber.StatusBadRequest, "Missing required fields")
+		if body != nil {
+			for name, script := range map[string]string{
+				"pre_deploy":  body.PreDeploy,
+				"post_deploy": body.PostDeploy,
+			} {
+				if err := validateScript(name, script); err != nil {
+					return fiber.NewError(fiber.StatusBadRequest, err.Error())
+				}
+			}
 		}
 
-		app := getAppById(id)
-		if app == nil {
-			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
-		}
+		app.Hooks = body
 
-		deployment, err := app.Deploy(body.Branch, body.Commit)
-		if err != nil {
-			return fiber.NewError(fiber.StatusBadRequest, err.Error())
-		}
+		writeConfig()
 
-		return c.JSON(deployment)
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
 	})
 
-	app.Delete("/runner/api/deployment/:id", func(c *fiber.Ctx) error {
+	app.Post("/runner/api/app/:id/services", func(c *fiber.Ctx) error {
 		id := c.Params("id", "")
 		if id == "" {
-			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
 		}
 
-		deployment := getDeploymentById(id)
-		if deployment == nil {
-			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
 		}
 
-		// Delete deployment
-		deployment.App.Deployments = lo.Filter(
-			deployment.App.Deployments,
-			func(d *Deployment, i int) bool {
-				return d.Id != id
-			},
-		)
+		// Empty body removes the app services. Applies to new deployments
+		var body map[string]Service
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
 
-		if deployment.ContainerId != nil {
-			dockerStop(*deployment.ContainerId)
-			dockerRemove(*deployment.ContainerId)
+		if err := validateServices(body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if len(body) > 0 && app.TemplateId != nil {
+			if template, ok := getTemplate(*app.TemplateId); ok && template.Run.IsStatic() {
+				return fiber.NewError(fiber.StatusBadRequest, "Services are not supported by static deployments")
+			}
 		}
 
+		app.Services = body
+
 		writeConfig()
 
 		return c.JSON(fiber.Map{
 			"success": true,
 		})
-
 	})
 
-	app.Get("/runner/api/deployment/:id/logs/:logType", func(c *fiber.Ctx) error {
+	app.Post("/runner/api/app/:id/domain", func(c *fiber.Ctx) error {
 		id := c.Params("id", "")
 		if id == "" {
-			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
 		}
 
-		logType := c.Params("logType", "")
-
-		deployment := getDeploymentById(id)
-		if deployment == nil {
-			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		var body struct {
+			Domain string `json:"domain"`
+			// Empty routes to the production deployment
+			Branch string `json:"branch"`
 		}
 
-		if deployment.BuildJob == nil {
-			return fiber.NewError(fiber.StatusBadRequest, "No build job found")
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
 
-		var err error
-		var logs string
-
-		switch logType {
-		case "build":
-			logs, err = deployment.BuildJob.GetLogs()
-			if err != nil {
-				return fiber.NewError(fiber.StatusBadRequest, err.Error())
-			}
-		case "running":
-			logs, err = deployment.GetLogs()
-			if err != nil {
-				return fiber.NewError(fiber.StatusBadRequest, err.Error())
-			}
-		case "requests":
-			logs = strings.Join(deployment.RequestsLog, "\n")
-		default:
-			return fiber.NewError(fiber.StatusBadRequest, "Invalid log type")
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
 		}
 
-		var deploymentUrl string
-		if deployment.Status == "Running" {
-			deploymentUrl = deployment.GetUrl()
+		err := app.AddCustomDomain(body.Domain, body.Branch)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
 		}
+
+		writeConfig()
+
 		return c.JSON(fiber.Map{
-			"logs":         logs,
-			"build_status": deployment.BuildJob.Status,
-			"url":          deploymentUrl,
+			"success": true,
 		})
 	})
 
-	app.Post("/runner/api/app/:id/webhook/:provider", func(c *fiber.Ctx) error {
+	app.Delete("/runner/api/app/:id/domain/:domain", func(c *fiber.Ctx) error {
 		id := c.Params("id", "")
 		if id == "" {
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
@@ -398,8 +674,660 @@ func main() {
 			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
 		}
 
-		provider := c.Params("provider", "")
-
+		err := app.RemoveCustomDomain(c.Params("domain", ""))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		writeConfig()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Get("/runner/api/app/:id/volumes", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		volumes, err := app.ListVolumes()
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(fiber.Map{
+			"volumes": app.Volumes,
+			"docker":  volumes,
+		})
+	})
+
+	app.Post("/runner/api/app/:id/volumes", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		var body Volume
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		err := app.SetVolume(body)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		writeConfig()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Delete("/runner/api/app/:id/volumes/:name", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		err := app.DeleteVolume(c.Params("name", ""))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		writeConfig()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Post("/runner/api/app/:id/volumes/:name/snapshot", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		var body struct {
+			DeploymentId string `json:"deployment_id"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		// Snapshot the app volume unless a deployment copy is selected
+		var deployment *Deployment
+		if body.DeploymentId != "" {
+			deployment = getDeploymentById(body.DeploymentId)
+			if deployment == nil || deployment.App != app {
+				return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+			}
+		}
+
+		snapshotId, err := app.SnapshotVolume(c.Params("name", ""), deployment)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(fiber.Map{
+			"success":  true,
+			"snapshot": snapshotId,
+		})
+	})
+
+	app.Delete("/runner/api/app/:id/volumes/:name/snapshots/:snapshot", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		err := app.DeleteSnapshot(c.Params("name", ""), c.Params("snapshot", ""))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Post("/runner/api/app/:id/retention", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		// Empty body keeps all deployments
+		var body *RetentionPolicy
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		if body != nil {
+			if err := body.Validate(); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		app.Retention = body
+
+		writeConfig()
+
+		// Apply right away instead of waiting for the scheduler
+		go enforceRetention()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Delete("/runner/api/app/:id", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		// Delete app
+		apps = lo.Filter(apps, func(a *App, i int) bool {
+			return a.Id != id
+		})
+
+		// Delete deployments
+		for _, deployment := range app.GetDeployments() {
+			deployment.Destroy()
+		}
+		app.removeNetwork()
+		if err := app.removeVolumes(map[string]string{labelApp: app.Id}); err != nil {
+			log.Println("[Volumes]", err)
+		}
+
+		writeConfig()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+
+	})
+
+	app.Post("/runner/api/app/:id/deploy", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		var body struct {
+			Branch string `json:"branch"`
+			Commit string `json:"commit"`
+		}
+
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if body.Branch == "" || body.Commit == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Missing required fields")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		deployment, err := app.Deploy(body.Branch, body.Commit)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(deployment)
+	})
+
+	app.Delete("/runner/api/deployment/:id", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		// Delete deployment
+		deployment.App.RemoveDeployment(deployment)
+
+		writeConfig()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+
+	})
+
+	app.Get("/runner/api/deployment/:id/logs/:logType", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		logType := c.Params("logType", "")
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		if deployment.BuildJob == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "No build job found")
+		}
+
+		var err error
+		var logs string
+
+		switch logType {
+		case "build":
+			logs, err = deployment.BuildJob.GetLogs()
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		case "running":
+			logs, err = deployment.GetLogs()
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		case "hooks":
+			logs, err = deployment.GetHooksLogs()
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		case "requests":
+			logs = strings.Join(deployment.RequestsLog, "\n")
+		default:
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid log type")
+		}
+
+		var deploymentUrl string
+		if deployment.GetStatus() == StateRunning {
+			deploymentUrl = deployment.GetUrl()
+		}
+		return c.JSON(fiber.Map{
+			"logs":         logs,
+			"build_status": deployment.BuildJob.Status,
+			"url":          deploymentUrl,
+		})
+	})
+
+	app.Get("/runner/api/deployment/:id/timeline", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		return c.JSON(fiber.Map{
+			"status":   deployment.GetStatus(),
+			"timeline": deployment.GetTimeline(),
+		})
+	})
+
+	app.Post("/runner/api/deployment/:id/stop", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		err := deployment.Stop()
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Post("/runner/api/deployment/:id/start", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		if status := deployment.GetStatus(); !canTransition(status, StateStarting) {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Deployment is %s", status))
+		}
+
+		// Waits for the readiness probe, poll the timeline for progress
+		go func() {
+			err := deployment.Start("Started using the API")
+			if err != nil {
+				log.Println("[Deployment]", err)
+			}
+		}()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Post("/runner/api/deployment/:id/restart", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		status := deployment.GetStatus()
+		if !canTransition(status, StateStopped) && !canTransition(status, StateStarting) {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Deployment is %s", status))
+		}
+
+		go func() {
+			err := deployment.Restart()
+			if err != nil {
+				log.Println("[Deployment]", err)
+			}
+		}()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Post("/runner/api/deployment/:id/redeploy", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		var body struct {
+			// Skip the build and use the artifact of the deployment
+			ReuseArtifact bool `json:"reuse_artifact"`
+			// Replaces the env of the deployment
+			Env *string `json:"env"`
+		}
+
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		redeployment, err := deployment.App.Redeploy(deployment, body.ReuseArtifact, body.Env)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(redeployment)
+	})
+
+	app.Post("/runner/api/app/:id/rollback", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		var body struct {
+			Branch string `json:"branch"`
+			// Defaults to the previous running deployment of the branch
+			DeploymentId string `json:"deployment_id"`
+		}
+
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if body.Branch == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Missing required fields")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		deployment, err := app.Rollback(body.Branch, body.DeploymentId)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		writeConfig()
+
+		return c.JSON(deployment)
+	})
+
+	app.Post("/runner/api/deployment/:id/promote", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		err := deployment.App.Promote(deployment)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		writeConfig()
+
+		return c.JSON(fiber.Map{
+			"success":        true,
+			"production_url": deployment.App.GetProductionUrl(),
+		})
+	})
+
+	app.Post("/runner/api/deployment/:id/pin", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		var body struct {
+			Pinned bool `json:"pinned"`
+		}
+
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		deployment.Pinned = body.Pinned
+
+		writeConfig()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Get("/runner/api/deployment/:id/logs/:logType/download", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid deployment id")
+		}
+
+		logType := c.Params("logType", "")
+
+		deployment := getDeploymentById(id)
+		if deployment == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown deployment id")
+		}
+
+		var logPath string
+		switch logType {
+		case "build":
+			if deployment.BuildJob != nil {
+				logPath = deployment.BuildJob.LogPath
+			}
+		case "hooks":
+			logPath = deployment.HooksLogPath
+		default:
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid log type")
+		}
+
+		if logPath == "" {
+			return fiber.NewError(fiber.StatusNotFound, "No log file found")
+		}
+		if _, err := os.Stat(logPath); os.IsNotExist(err) {
+			return fiber.NewError(fiber.StatusNotFound, "Log file expired")
+		}
+
+		return c.Download(logPath, fmt.Sprintf("%s-%s.log", deployment.GetSlug(), logType))
+	})
+
+	app.Get("/runner/api/registry", func(c *fiber.Ctx) error {
+		// Never expose passwords
+		return c.JSON(lo.Map(listRegistries(), func(r *RegistryCredential, _ int) fiber.Map {
+			return fiber.Map{
+				"host":     r.Host,
+				"username": r.Username,
+			}
+		}))
+	})
+
+	app.Post("/runner/api/registry", func(c *fiber.Ctx) error {
+		var body struct {
+			Host     string `json:"host"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+
+		if err := c.BodyParser(&body); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if body.Host == "" || body.Username == "" || body.Password == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Missing required fields")
+		}
+
+		err := setRegistryCredential(body.Host, body.Username, body.Password)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		writeRegistries()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	// Accepts a docker config.json as body
+	app.Post("/runner/api/registry/import", func(c *fiber.Ctx) error {
+		hosts, err := importDockerConfig(c.Body())
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		writeRegistries()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"hosts":   hosts,
+		})
+	})
+
+	app.Delete("/runner/api/registry/:host", func(c *fiber.Ctx) error {
+		host := c.Params("host", "")
+		if host == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid registry host")
+		}
+
+		if getRegistryByHost(normalizeRegistryHost(host)) == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown registry host")
+		}
+
+		removeRegistryCredential(host)
+		writeRegistries()
+
+		return c.JSON(fiber.Map{
+			"success": true,
+		})
+	})
+
+	app.Post("/runner/api/app/:id/webhook/:provider", func(c *fiber.Ctx) error {
+		id := c.Params("id", "")
+		if id == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid app id")
+		}
+
+		app := getAppById(id)
+		if app == nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Unkown app id")
+		}
+
+		provider := c.Params("provider", "")
+
 		var r http.Request
 		err := fasthttpadaptor.ConvertRequest(c.Context(), &r, true)
 		if err != nil {
@@ -407,11 +1335,13 @@ func main() {
 		}
 
 		var commit, branch string
+		// Set for deleted branches
+		var deleted bool
 
 		switch provider {
 		case "github":
 			githubHook, _ := github.New(github.Options.Secret(app.WebhookSecret))
-			payload, err := githubHook.Parse(&r, github.PushEvent)
+			payload, err := githubHook.Parse(&r, github.PushEvent, github.DeleteEvent)
 			if err != nil {
 				if err == github.ErrEventNotFound {
 					return fiber.NewError(fiber.StatusBadRequest, "Invalid event")
@@ -423,8 +1353,24 @@ func main() {
 
 			case github.PushPayload:
 				push := payload.(github.PushPayload)
+				var ok bool
 				commit = push.After
-				branch = plumbing.ReferenceName(push.Ref).Short()
+				branch, deleted, ok = parsePushRef(push.Ref, push.After, push.Deleted)
+				if !ok {
+					return c.JSON(fiber.Map{
+						"success": true,
+					})
+				}
+
+			case github.DeletePayload:
+				del := payload.(github.DeletePayload)
+				if del.RefType != "branch" {
+					return c.JSON(fiber.Map{
+						"success": true,
+					})
+				}
+				branch = del.Ref
+				deleted = true
 			}
 
 		case "gitlab":
@@ -440,14 +1386,29 @@ func main() {
 			switch payload.(type) {
 			case gitlab.PushEventPayload:
 				push := payload.(gitlab.PushEventPayload)
+				var ok bool
 				commit = push.After
-				branch = plumbing.ReferenceName(push.Ref).Short()
+				branch, deleted, ok = parsePushRef(push.Ref, push.After, false)
+				if !ok {
+					return c.JSON(fiber.Map{
+						"success": true,
+					})
+				}
 			}
 
 		default:
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid provider type")
 		}
 
+		// Deleted branches never build
+		if deleted {
+			go app.RemoveBranch(branch)
+
+			return c.JSON(fiber.Map{
+				"success": true,
+			})
+		}
+
 		go func() {
 			_, err := app.Deploy(branch, commit)
 			if err != nil {
@@ -490,28 +1451,45 @@ func main() {
 			return fiber.NewError(fiber.StatusNotFound, "Deployment not found")
 		}
 
-		if deployment.Status != "Running" {
-			return c.Redirect("/runner/deployment/" + deployment.Id + "/logs?logType=build")
+		// Scale to zero
+		if deployment.GetStatus() == StateSleeping || deployment.isWaking() {
+			handled, err := deployment.serveWaking(c)
+			if handled || err != nil {
+				return err
+			}
 		}
 
-		// Rewrite request host
-		url := c.Request().URI()
-		// Always downgrade to http
-		url.SetScheme("http")
-		url.SetHost(fmt.Sprintf("127.0.0.1:%s", *deployment.Port))
+		if deployment.GetStatus() != StateRunning {
+			return c.Redirect("/runner/deployment/" + deployment.Id + "/logs?logType=build")
+		}
 
-		err := proxy.Do(c, url.String())
+		template, err := deployment.getTemplate()
 		if err != nil {
 			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 		}
 
-		resp := c.Response()
-		deployment.RequestsLogLock.Lock()
-		deployment.RequestsLog = append(
-			deployment.RequestsLog,
-			fmt.Sprintf("%s %s %d", c.Method(), c.Path(), resp.StatusCode()),
-		)
-		deployment.RequestsLogLock.Unlock()
+		if template.Run.IsStatic() {
+			// Served without a container
+			err = deployment.ServeStatic(c, template)
+		} else {
+			// Rewrite request host
+			url := c.Request().URI()
+			// Always downgrade to http
+			url.SetScheme("http")
+			url.SetHost(deployment.getAddress())
+
+			err = proxy.Do(c, url.String())
+			if err != nil {
+				// Container might have been OOM killed
+				deployment.CheckContainer()
+				err = fiber.NewError(fiber.StatusInternalServerError, err.Error())
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		deployment.recordRequest(c)
 		//return c.Next()
 
 		return nil
@@ -523,7 +1501,7 @@ func main() {
 			Prompt: autocert.AcceptTOS,
 			// Replace with your domain
 			HostPolicy: func(_ context.Context, host string) error {
-				if host == domain {
+				if host == domain || isCustomDomain(host) {
 					return nil
 				}
 
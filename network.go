@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// Every app gets its own bridge network. Runner proxies to the container
+// address on that network, so no host ports are published and deployments
+// of different apps can not reach each other
+func (a *App) GetNetworkName() string {
+	return fmt.Sprintf("runner-app-%s", strings.ToLower(a.Id))
+}
+
+// ensureNetwork creates the app network if it does not exist yet
+func (a *App) ensureNetwork() (string, error) {
+	name := a.GetNetworkName()
+
+	err := dockerEnsureNetwork(name, map[string]string{labelApp: a.Id})
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func (a *App) removeNetwork() {
+	// Runner itself is an endpoint as well, which blocks removing the network
+	if self := os.Getenv("RUNNER_CONTAINER"); self != "" {
+		err := docker.NetworkDisconnect(context.Background(), a.GetNetworkName(), self, true)
+		if err != nil && !client.IsErrNotFound(err) {
+			log.Println("[Network]", err)
+		}
+	}
+
+	err := docker.NetworkRemove(context.Background(), a.GetNetworkName())
+	if err != nil && !client.IsErrNotFound(err) {
+		log.Println("[Network]", err)
+	}
+}
+
+func dockerEnsureNetwork(name string, labels map[string]string) error {
+	inspect, err := docker.NetworkInspect(context.Background(), name, types.NetworkInspectOptions{})
+	if client.IsErrNotFound(err) {
+		log.Println("[Network] Creating network:", name)
+		_, err = docker.NetworkCreate(context.Background(), name, types.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         "bridge",
+			Labels:         labels,
+		})
+		// Created by another deployment of the app in the meantime
+		if errdefs.IsConflict(err) {
+			err = nil
+		}
+		if err == nil {
+			inspect, err = docker.NetworkInspect(context.Background(), name, types.NetworkInspectOptions{})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Runner itself runs in a container without host networking and has to
+	// join the network to reach deployments
+	self := os.Getenv("RUNNER_CONTAINER")
+	if self == "" {
+		return nil
+	}
+	for id, endpoint := range inspect.Containers {
+		if strings.HasPrefix(id, self) || endpoint.Name == self {
+			return nil
+		}
+	}
+
+	err = docker.NetworkConnect(context.Background(), name, self, &network.EndpointSettings{})
+	// Connected by a concurrent call
+	if errdefs.IsForbidden(err) || errdefs.IsConflict(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to connect runner to network %s: %w", name, err)
+	}
+	return nil
+}
+
+// dockerContainerIP returns the address of the container on the network. It
+// changes whenever the container is started
+func dockerContainerIP(id, networkName string) (string, error) {
+	inspect, err := docker.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, ok := inspect.NetworkSettings.Networks[networkName]
+	if !ok || endpoint.IPAddress == "" {
+		return "", fmt.Errorf("Container is not connected to network %s", networkName)
+	}
+
+	return endpoint.IPAddress, nil
+}
+
+// updateAddress looks up the address of the started run container
+func (d *Deployment) updateAddress(template TemplateConfig) error {
+	if d.ContainerId == nil {
+		return errors.New("Deployment has no container")
+	}
+
+	ip, err := dockerContainerIP(*d.ContainerId, d.App.GetNetworkName())
+	if err != nil && d.Port != nil {
+		// Legacy container publishing a host port
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	port := strings.Split(template.Run.Port, "/")[0]
+	d.Address = ptr(fmt.Sprintf("%s:%s", ip, port))
+	return nil
+}
+
+// getAddress returns host:port of the run container
+func (d *Deployment) getAddress() string {
+	if d.Address != nil {
+		return *d.Address
+	}
+
+	// Deployments started before app networks published a host port
+	if d.Port != nil {
+		return fmt.Sprintf("127.0.0.1:%s", *d.Port)
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+var ErrProbeFailed = errors.New("Readiness probe failed")
+
+// Probe types
+const (
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+	ProbeNone = "none"
+)
+
+const (
+	defaultProbeTimeout  = time.Minute
+	defaultProbeInterval = time.Second
+	probeRequestTimeout  = 5 * time.Second
+)
+
+// Probe checks whether a started run container accepts requests. The
+// deployment only becomes routable once the probe passed. Without a probe the
+// run port is checked using TCP
+type Probe struct {
+	// "tcp" (default), "http" or "none"
+	Type string `toml:"type" json:"type"`
+	// HTTP probes: path that has to respond with 2xx or 3xx, defaults to /
+	Path     string `toml:"path"     json:"path"`
+	Timeout  string `toml:"timeout"  json:"timeout"`
+	Interval string `toml:"interval" json:"interval"`
+}
+
+func (p Probe) GetType() string {
+	if p.Type == "" {
+		return ProbeTCP
+	}
+	return p.Type
+}
+
+func (p Probe) GetPath() string {
+	if p.Path == "" {
+		return "/"
+	}
+	return p.Path
+}
+
+func (p Probe) GetTimeout() (time.Duration, error) {
+	return parseProbeDuration(p.Timeout, defaultProbeTimeout)
+}
+
+func (p Probe) GetInterval() (time.Duration, error) {
+	return parseProbeDuration(p.Interval, defaultProbeInterval)
+}
+
+func parseProbeDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("must be positive: %s", value)
+	}
+
+	return duration, nil
+}
+
+func (p Probe) Validate() error {
+	if !lo.Contains([]string{ProbeTCP, ProbeHTTP, ProbeNone}, p.GetType()) {
+		return fmt.Errorf("invalid type: %s", p.Type)
+	}
+	if !strings.HasPrefix(p.GetPath(), "/") {
+		return fmt.Errorf("path must start with /: %s", p.Path)
+	}
+	if _, err := p.GetTimeout(); err != nil {
+		return fmt.Errorf("timeout: %w", err)
+	}
+	if _, err := p.GetInterval(); err != nil {
+		return fmt.Errorf("interval: %w", err)
+	}
+
+	return nil
+}
+
+// check runs the probe once against address (host:port)
+func (p Probe) check(address, host string) error {
+	switch p.GetType() {
+	case ProbeHTTP:
+		return checkHttp(fmt.Sprintf("http://%s%s", address, p.GetPath()), host)
+	case ProbeTCP:
+		conn, err := net.DialTimeout("tcp", address, probeRequestTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	return nil
+}
+
+func checkHttp(url, host string) error {
+	client := http.Client{
+		Timeout: probeRequestTimeout,
+		// Redirects (e.g. to a login page) count as ready
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("GET %s: status %d: %s", req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// waitReady runs the readiness probe of the template until it passes, the
+// timeout is reached or the run container exits
+func (d *Deployment) waitReady(template TemplateConfig, buildLog *LogFile) (err error) {
+	probe := template.Run.Readiness
+	if probe.GetType() == ProbeNone {
+		return nil
+	}
+
+	timeout, err := probe.GetTimeout()
+	if err != nil {
+		return
+	}
+	interval, err := probe.GetInterval()
+	if err != nil {
+		return
+	}
+
+	address := d.getAddress()
+	buildLog.Printf("Waiting for readiness probe (%s, timeout %s)", probe.GetType(), timeout)
+
+	defer func() {
+		if err != nil {
+			// Make the reason visible without switching to the container logs
+			logs, _ := dockerLogs(*d.ContainerId)
+			buildLog.Printf("Container output:\n%s", tailLines(logs, 20))
+		}
+	}()
+
+	start := time.Now()
+	for {
+		probeErr := probe.check(address, d.GetDomain())
+		if probeErr == nil {
+			buildLog.Printf("Readiness probe passed after %s", time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+
+		inspect, err := docker.ContainerInspect(context.Background(), *d.ContainerId)
+		if err != nil {
+			return err
+		}
+		if inspect.State.OOMKilled {
+			return ErrOOMKilled
+		}
+		if !inspect.State.Running {
+			return fmt.Errorf(
+				"%w: container exited with code %d: %s",
+				ErrProbeFailed,
+				inspect.State.ExitCode,
+				probeErr,
+			)
+		}
+
+		if time.Since(start) > timeout {
+			return fmt.Errorf("%w after %s: %s", ErrProbeFailed, timeout, probeErr)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func tailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
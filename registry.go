@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/samber/lo"
+)
+
+const registriesPath = "./registries.json"
+
+var ErrNoSecretKey = errors.New("RUNNER_SECRET_KEY is not set")
+
+type RegistryCredential struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	// AES-GCM encrypted password, see encryptSecret
+	Password string `json:"password"`
+}
+
+// Docker config.json, only the parts we can import
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// Entries are never modified, only replaced, so they can be used after the
+// lock is released
+var registries []*RegistryCredential
+var registriesLock sync.RWMutex
+var secretKey []byte
+
+func loadRegistries() {
+	if _, err := os.Stat(registriesPath); os.IsNotExist(err) {
+		return
+	}
+
+	data, err := os.ReadFile(registriesPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = json.Unmarshal(data, &registries)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(registries) > 0 && secretKey == nil {
+		log.Fatal("RUNNER_SECRET_KEY is required to use the credentials in ", registriesPath)
+	}
+}
+
+func writeRegistries() {
+	registriesLock.RLock()
+	data, err := json.MarshalIndent(registries, "", "  ")
+	registriesLock.RUnlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.WriteFile(registriesPath, data, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadSecretKey reads the encryption key for stored credentials from
+// RUNNER_SECRET_KEY (base64, 32 bytes). It is never stored by runner: a key
+// next to registries.json would not protect the passwords. Without a key no
+// credentials can be stored
+func loadSecretKey() {
+	env := os.Getenv("RUNNER_SECRET_KEY")
+	if env == "" {
+		log.Println("[Registry] WARNING: RUNNER_SECRET_KEY is not set, private registry credentials are disabled")
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(env)
+	if err != nil {
+		log.Fatal("RUNNER_SECRET_KEY: ", err)
+	}
+	if len(key) != 32 {
+		log.Fatal("RUNNER_SECRET_KEY must be 32 bytes long")
+	}
+	secretKey = key
+}
+
+func encryptSecret(plain string) (string, error) {
+	if secretKey == nil {
+		return "", ErrNoSecretKey
+	}
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encrypted string) (string, error) {
+	if secretKey == nil {
+		return "", ErrNoSecretKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("Encrypted secret is too short")
+	}
+	nonce, cipherText := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// normalizeRegistryHost maps the different ways to write a registry (config
+// keys, image references) onto the same host name
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.Split(host, "/")[0]
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+
+	return host
+}
+
+func getRegistryHost(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+
+	return normalizeRegistryHost(reference.Domain(named)), nil
+}
+
+func getRegistryByHost(host string) *RegistryCredential {
+	registriesLock.RLock()
+	defer registriesLock.RUnlock()
+
+	credential, found := lo.Find(registries, func(r *RegistryCredential) bool {
+		return r.Host == host
+	})
+	if !found {
+		return nil
+	}
+	return credential
+}
+
+func newRegistryCredential(host, username, password string) (*RegistryCredential, error) {
+	encrypted, err := encryptSecret(password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegistryCredential{
+		Host:     normalizeRegistryHost(host),
+		Username: username,
+		Password: encrypted,
+	}, nil
+}
+
+// putRegistryCredentials adds the credentials or replaces the ones of the
+// same host, all at once
+func putRegistryCredentials(credentials ...*RegistryCredential) {
+	registriesLock.Lock()
+	defer registriesLock.Unlock()
+
+	for _, credential := range credentials {
+		registries = append(lo.Filter(registries, func(r *RegistryCredential, _ int) bool {
+			return r.Host != credential.Host
+		}), credential)
+	}
+}
+
+// listRegistries returns a copy of the stored credentials
+func listRegistries() []*RegistryCredential {
+	registriesLock.RLock()
+	defer registriesLock.RUnlock()
+
+	return append([]*RegistryCredential(nil), registries...)
+}
+
+func setRegistryCredential(host, username, password string) error {
+	credential, err := newRegistryCredential(host, username, password)
+	if err != nil {
+		return err
+	}
+
+	putRegistryCredentials(credential)
+	return nil
+}
+
+func removeRegistryCredential(host string) {
+	host = normalizeRegistryHost(host)
+
+	registriesLock.Lock()
+	defer registriesLock.Unlock()
+
+	registries = lo.Filter(registries, func(r *RegistryCredential, _ int) bool {
+		return r.Host != host
+	})
+}
+
+// getRegistryAuth returns the encoded auth header value for pulling image,
+// or an empty string if no credentials are configured for its registry
+func getRegistryAuth(image string) (string, error) {
+	host, err := getRegistryHost(image)
+	if err != nil {
+		return "", err
+	}
+
+	credential := getRegistryByHost(host)
+	if credential == nil {
+		return "", nil
+	}
+
+	password, err := decryptSecret(credential.Password)
+	if err != nil {
+		return "", fmt.Errorf("Could not decrypt credentials for %s: %w", host, err)
+	}
+
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      credential.Username,
+		Password:      password,
+		ServerAddress: host,
+	})
+}
+
+// importDockerConfig imports all inline credentials of a docker config.json.
+// Returns the imported registry hosts
+func importDockerConfig(data []byte) ([]string, error) {
+	var config dockerConfigFile
+	err := json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CredsStore != "" || len(config.CredHelpers) > 0 {
+		log.Println("[Registry] Credential helpers are not supported, only inline auths are imported")
+	}
+
+	// Only apply the credentials once all entries are valid
+	var credentials []*RegistryCredential
+	for host, auth := range config.Auths {
+		username, password := auth.Username, auth.Password
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", host, err)
+			}
+			var found bool
+			username, password, found = strings.Cut(string(decoded), ":")
+			if !found {
+				return nil, fmt.Errorf("%s: invalid auth value", host)
+			}
+		}
+		if username == "" {
+			continue
+		}
+
+		credential, err := newRegistryCredential(host, username, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", host, err)
+		}
+		credentials = append(credentials, credential)
+	}
+
+	putRegistryCredentials(credentials...)
+
+	return lo.Map(credentials, func(c *RegistryCredential, _ int) string {
+		return c.Host
+	}), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/samber/lo"
+)
+
+const repoConfigFile = "runner.toml"
+
+// Fields a repository is allowed to override. Images and resources stay under
+// control of the server
+var repoConfigFields = map[string][]string{
+	"template": nil,
+	"env":      nil,
+	"build":    {"script", "artifact"},
+	"run":      {"script", "port", "mode", "spa", "not_found", "cache_control", "readiness", "restart"},
+	"hooks":    {"pre_deploy", "post_deploy"},
+}
+
+// loadRepoConfig returns the effective template for the deployment: the app
+// template (or the one selected in runner.toml) with the runner.toml
+// overrides from the repository applied
+func loadRepoConfig(repoPath string, templateId string) (config TemplateConfig, found bool, err error) {
+	data, err := os.ReadFile(path.Join(repoPath, repoConfigFile))
+	if os.IsNotExist(err) {
+		template, ok := getTemplate(templateId)
+		if !ok {
+			return config, false, fmt.Errorf("Unknown template: %s", templateId)
+		}
+		return template, false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	overrides := make(map[string]any)
+	_, err = toml.Decode(string(data), &overrides)
+	if err != nil {
+		return config, true, fmt.Errorf("%s: %w", repoConfigFile, err)
+	}
+
+	err = validateRepoConfig(overrides)
+	if err != nil {
+		return config, true, fmt.Errorf("%s: %w", repoConfigFile, err)
+	}
+
+	if selected, ok := overrides["template"].(string); ok {
+		templateId = selected
+	}
+	delete(overrides, "template")
+
+	sources, _ := loadTemplateSources()
+	table, err := resolveTemplateTable(templateId, sources, nil)
+	if err != nil {
+		return
+	}
+
+	config, err = decodeTemplate(mergeTables(table, overrides))
+	if err != nil {
+		return config, true, fmt.Errorf("%s: %w", repoConfigFile, err)
+	}
+
+	return config, true, nil
+}
+
+func validateRepoConfig(overrides map[string]any) error {
+	for key, value := range overrides {
+		fields, ok := repoConfigFields[key]
+		if !ok {
+			return fmt.Errorf("%s can not be overridden", key)
+		}
+
+		if key == "template" {
+			if _, ok := value.(string); !ok {
+				return errors.New("template must be a string")
+			}
+			continue
+		}
+
+		table, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s must be a table", key)
+		}
+		if fields == nil {
+			continue
+		}
+
+		for field := range table {
+			if !lo.Contains(fields, field) {
+				return fmt.Errorf("%s.%s can not be overridden", key, field)
+			}
+		}
+	}
+
+	// Must not point outside the build directory
+	if build, ok := overrides["build"].(map[string]any); ok {
+		if artifact, ok := build["artifact"]; ok {
+			artifact, isString := artifact.(string)
+			if !isString || !filepath.IsLocal(artifact) {
+				return fmt.Errorf("build.artifact must be a relative path inside the repository: %v", build["artifact"])
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestValidateRepoConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]any
+		wantErr   bool
+	}{
+		{"empty", map[string]any{}, false},
+		{"template", map[string]any{"template": "nextjs"}, false},
+		{"template not a string", map[string]any{"template": 1}, true},
+		{"env", map[string]any{"env": map[string]any{"FOO": "bar"}}, false},
+		{"build script", map[string]any{"build": map[string]any{"script": "make"}}, false},
+		{"build image", map[string]any{"build": map[string]any{"image": "evil"}}, true},
+		{"run port", map[string]any{"run": map[string]any{"port": "8080"}}, false},
+		{"run image", map[string]any{"run": map[string]any{"image": "evil"}}, true},
+		{"hooks", map[string]any{"hooks": map[string]any{"pre_deploy": "migrate"}}, false},
+		{"resources", map[string]any{"resources": map[string]any{"memory": "8g"}}, true},
+		{"services", map[string]any{"services": map[string]any{}}, true},
+		{"not a table", map[string]any{"build": "make"}, true},
+		{"artifact", map[string]any{"build": map[string]any{"artifact": "dist"}}, false},
+		{"nested artifact", map[string]any{"build": map[string]any{"artifact": "app/.next"}}, false},
+		{"artifact parent", map[string]any{"build": map[string]any{"artifact": "../../.."}}, true},
+		{"artifact escaping", map[string]any{"build": map[string]any{"artifact": "dist/../../secret.key"}}, true},
+		{"artifact absolute", map[string]any{"build": map[string]any{"artifact": "/etc"}}, true},
+		{"artifact empty", map[string]any{"build": map[string]any{"artifact": ""}}, true},
+		{"artifact not a string", map[string]any{"build": map[string]any{"artifact": 1}}, true},
+	}
+
+	for _, test := range tests {
+		err := validateRepoConfig(test.overrides)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: validateRepoConfig() = %v, want error: %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/api/types/blkiodev"
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+var ErrOOMKilled = errors.New("Container was killed because it ran out of memory")
+
+// ResourceLimits are applied to build and run containers. Zero values mean
+// unlimited
+type ResourceLimits struct {
+	CPUs   float64 `toml:"cpus"   json:"cpus"`
+	Memory string  `toml:"memory" json:"memory"` // e.g. "512m", "2g"
+	Pids   int64   `toml:"pids"   json:"pids"`
+	// Write limit (e.g. "50m" per second) for the block device at DiskDevice
+	DiskWriteBps string `toml:"disk_write_bps" json:"disk_write_bps"`
+	DiskDevice   string `toml:"disk_device"    json:"disk_device"`
+}
+
+// Merge returns r with all fields that are set in override replaced
+func (r ResourceLimits) Merge(override *ResourceLimits) ResourceLimits {
+	if override == nil {
+		return r
+	}
+
+	if override.CPUs != 0 {
+		r.CPUs = override.CPUs
+	}
+	if override.Memory != "" {
+		r.Memory = override.Memory
+	}
+	if override.Pids != 0 {
+		r.Pids = override.Pids
+	}
+	if override.DiskWriteBps != "" {
+		r.DiskWriteBps = override.DiskWriteBps
+	}
+	if override.DiskDevice != "" {
+		r.DiskDevice = override.DiskDevice
+	}
+
+	return r
+}
+
+// ToDocker converts the limits into docker container resources. Also used to
+// validate limits
+func (r ResourceLimits) ToDocker() (resources container.Resources, err error) {
+	if r.CPUs < 0 {
+		return resources, errors.New("cpus must be positive")
+	}
+	resources.NanoCPUs = int64(r.CPUs * 1e9)
+
+	if r.Memory != "" {
+		resources.Memory, err = units.RAMInBytes(r.Memory)
+		if err != nil {
+			return resources, fmt.Errorf("memory: %w", err)
+		}
+		// Disable swap so the limit is enforced
+		resources.MemorySwap = resources.Memory
+	}
+
+	if r.Pids < 0 {
+		return resources, errors.New("pids must be positive")
+	}
+	if r.Pids > 0 {
+		resources.PidsLimit = ptr(r.Pids)
+	}
+
+	if r.DiskWriteBps != "" {
+		if r.DiskDevice == "" {
+			return resources, errors.New("disk_write_bps requires disk_device")
+		}
+
+		var rate int64
+		rate, err = units.RAMInBytes(r.DiskWriteBps)
+		if err != nil {
+			return resources, fmt.Errorf("disk_write_bps: %w", err)
+		}
+		resources.BlkioDeviceWriteBps = []*blkiodev.ThrottleDevice{
+			{Path: r.DiskDevice, Rate: uint64(rate)},
+		}
+	}
+
+	return resources, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// RetentionPolicy limits how many deployments of an app are kept. Pinned and
+// production deployments, branch alias targets and deployments that are still
+// in progress are never removed
+type RetentionPolicy struct {
+	// Number of deployments to keep per branch, 0 keeps all
+	KeepPerBranch int `json:"keep_per_branch"`
+	// Deployments older than this are removed, 0 keeps them forever
+	MaxAgeDays int `json:"max_age_days"`
+}
+
+func (r RetentionPolicy) Validate() error {
+	if r.KeepPerBranch < 0 {
+		return errors.New("keep_per_branch must not be negative")
+	}
+	if r.MaxAgeDays < 0 {
+		return errors.New("max_age_days must not be negative")
+	}
+	return nil
+}
+
+// expiredDeployments returns the deployments of the app that are not covered
+// by the retention policy anymore
+func (a *App) expiredDeployments() []*Deployment {
+	if a.Retention == nil {
+		return nil
+	}
+	policy := *a.Retention
+
+	var expired []*Deployment
+
+	// Newest first
+	byBranch := lo.GroupBy(a.GetDeployments(), func(d *Deployment) string {
+		return d.GitBranch
+	})
+	for _, deployments := range byBranch {
+		sort.Slice(deployments, func(i, j int) bool {
+			return deployments[i].Time.After(deployments[j].Time)
+		})
+
+		// Pinned and in progress deployments do not count towards the limit
+		counted := 0
+		for _, deployment := range deployments {
+			if deployment.Pinned || deployment.isInProgress() {
+				continue
+			}
+			counted++
+
+			if a.isAliasTarget(deployment) || a.isProduction(deployment) {
+				continue
+			}
+
+			tooMany := policy.KeepPerBranch > 0 && counted > policy.KeepPerBranch
+			tooOld := policy.MaxAgeDays > 0 &&
+				time.Since(deployment.Time) > time.Duration(policy.MaxAgeDays)*24*time.Hour
+			if tooMany || tooOld {
+				expired = append(expired, deployment)
+			}
+		}
+	}
+
+	return expired
+}
+
+// isInProgress reports whether the deployment is being built or started
+func (d *Deployment) isInProgress() bool {
+	switch d.GetStatus() {
+	case StatePending, StateBuilding, StateBuilt, StateRunningHooks, StateStarting:
+		return true
+	}
+	return false
+}
+
+// enforceRetention removes all expired deployments of all apps
+func enforceRetention() {
+	removed := 0
+	for _, app := range apps {
+		for _, deployment := range app.expiredDeployments() {
+			log.Println("[Retention] Removing deployment:", deployment.GetSlug())
+			app.RemoveDeployment(deployment)
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		writeConfig()
+	}
+}
+
+// watchRetention enforces the retention policies once per hour
+func watchRetention() {
+	for {
+		enforceRetention()
+		time.Sleep(time.Hour)
+	}
+}
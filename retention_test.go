@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+func TestExpiredDeployments(t *testing.T) {
+	now := time.Now()
+	newDeployment := func(id string, age time.Duration, status DeploymentState, pinned bool) *Deployment {
+		return &Deployment{
+			Id:        id,
+			Time:      now.Add(-age),
+			GitBranch: "main",
+			GitCommit: "0123456789abcdef",
+			Status:    status,
+			Pinned:    pinned,
+			StateLock: &sync.Mutex{},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		policy      RetentionPolicy
+		deployments []*Deployment
+		want        []string
+	}{
+		{
+			name:   "keeps newest",
+			policy: RetentionPolicy{KeepPerBranch: 2},
+			deployments: []*Deployment{
+				newDeployment("a", 1*time.Hour, StateRunning, false),
+				newDeployment("b", 2*time.Hour, StateRunning, false),
+				newDeployment("c", 3*time.Hour, StateRunning, false),
+			},
+			want: []string{"c"},
+		},
+		{
+			name:   "pinned do not count",
+			policy: RetentionPolicy{KeepPerBranch: 1},
+			deployments: []*Deployment{
+				newDeployment("a", 1*time.Hour, StateStopped, true),
+				newDeployment("b", 2*time.Hour, StateStopped, true),
+				newDeployment("c", 3*time.Hour, StateRunning, false),
+				newDeployment("d", 4*time.Hour, StateStopped, false),
+			},
+			want: []string{"d"},
+		},
+		{
+			name:   "in progress do not count",
+			policy: RetentionPolicy{KeepPerBranch: 1},
+			deployments: []*Deployment{
+				newDeployment("a", 1*time.Minute, StateBuilding, false),
+				newDeployment("b", 1*time.Hour, StateRunning, false),
+				newDeployment("c", 2*time.Hour, StateFailed, false),
+			},
+			want: []string{"c"},
+		},
+		{
+			name:   "max age",
+			policy: RetentionPolicy{MaxAgeDays: 7},
+			deployments: []*Deployment{
+				newDeployment("a", 24*time.Hour, StateRunning, false),
+				newDeployment("b", 8*24*time.Hour, StateStopped, false),
+				newDeployment("c", 9*24*time.Hour, StateStopped, true),
+			},
+			want: []string{"b"},
+		},
+	}
+
+	for _, test := range tests {
+		app := &App{Retention: &test.policy, Deployments: test.deployments}
+		got := lo.Map(app.expiredDeployments(), func(d *Deployment, _ int) string {
+			return d.Id
+		})
+		if len(got) != len(test.want) || len(lo.Intersect(got, test.want)) != len(test.want) {
+			t.Errorf("%s: expired = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
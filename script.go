@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/samber/lo"
+)
+
+// ScriptContext is available in build, run and hook scripts, e.g.
+// {{ .PackageManager }} install or {{ if eq .Branch "main" }}...{{ end }}.
+// Env values can be read using {{ index .Env "NAME" }}
+type ScriptContext struct {
+	App struct {
+		Id   string
+		Name string
+		Slug string
+	}
+	Deployment struct {
+		Id   string
+		Name string
+		Slug string
+	}
+	Branch         string
+	Commit         string
+	ShortCommit    string
+	Url            string
+	Domain         string
+	Port           string
+	PackageManager string
+	Env            map[string]string
+}
+
+var scriptFuncs = template.FuncMap{
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+func newScriptContext(d *Deployment, template TemplateConfig) ScriptContext {
+	var ctx ScriptContext
+
+	ctx.App.Id = d.App.Id
+	ctx.App.Name = d.App.Name
+	ctx.App.Slug = d.App.GetSlug()
+	ctx.Deployment.Id = d.Id
+	ctx.Deployment.Name = d.GetName()
+	ctx.Deployment.Slug = d.GetSlug()
+	ctx.Branch = d.GitBranch
+	ctx.Commit = d.GitCommit
+	ctx.ShortCommit = d.GitCommit[:7]
+	ctx.Url = d.GetUrl()
+	ctx.Domain = d.GetDomain()
+	ctx.Port = strings.Split(template.Run.Port, "/")[0]
+	ctx.PackageManager = d.App.PackageManager
+	ctx.Env = d.getEnv(template)
+
+	return ctx
+}
+
+func renderScript(name, source string, ctx ScriptContext) (string, error) {
+	// Legacy placeholder
+	source = strings.ReplaceAll(source, "%pm%", "{{ .PackageManager }}")
+
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(scriptFuncs).
+		Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	var script strings.Builder
+	err = tmpl.Execute(&script, ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return script.String(), nil
+}
+
+// validateScripts checks all scripts of the template for syntax errors and
+// unknown variables
+func validateScripts(config TemplateConfig) error {
+	scripts := map[string]string{
+		"build.script":      config.Build.Script,
+		"run.script":        config.Run.Script,
+		"hooks.pre_deploy":  config.Hooks.PreDeploy,
+		"hooks.post_deploy": config.Hooks.PostDeploy,
+	}
+
+	for name, source := range scripts {
+		err := validateScript(name, source)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateScript parses the script and checks every field reference against
+// ScriptContext, including branches that would not be taken when rendering
+func validateScript(name, source string) error {
+	source = strings.ReplaceAll(source, "%pm%", "{{ .PackageManager }}")
+
+	tmpl, err := template.New(name).Funcs(scriptFuncs).Parse(source)
+	if err != nil {
+		return err
+	}
+
+	checker := fieldChecker{tmpl: tmpl, root: reflect.TypeOf(ScriptContext{})}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		err = checker.check(t.Tree.Root, checker.root)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fieldChecker walks a parsed template and resolves field references on the
+// type of dot. A nil type means the type is unknown and is not checked
+type fieldChecker struct {
+	tmpl *template.Template
+	root reflect.Type
+}
+
+func (f fieldChecker) check(node parse.Node, dot reflect.Type) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, child := range node.Nodes {
+			if err := f.check(child, dot); err != nil {
+				return err
+			}
+		}
+
+	case *parse.ActionNode:
+		_, err := f.checkPipe(node.Pipe, dot)
+		return err
+
+	case *parse.TemplateNode:
+		_, err := f.checkPipe(node.Pipe, dot)
+		return err
+
+	case *parse.IfNode:
+		return f.checkBranch(&node.BranchNode, dot, dot)
+
+	case *parse.WithNode:
+		inner, err := f.checkPipe(node.Pipe, dot)
+		if err != nil {
+			return err
+		}
+		return f.checkBranch(&node.BranchNode, inner, dot)
+
+	case *parse.RangeNode:
+		inner, err := f.checkPipe(node.Pipe, dot)
+		if err != nil {
+			return err
+		}
+		if inner != nil {
+			switch inner.Kind() {
+			case reflect.Map, reflect.Slice, reflect.Array:
+				inner = inner.Elem()
+			default:
+				inner = nil
+			}
+		}
+		return f.checkBranch(&node.BranchNode, inner, dot)
+	}
+
+	return nil
+}
+
+func (f fieldChecker) checkBranch(node *parse.BranchNode, inner, dot reflect.Type) error {
+	if _, err := f.checkPipe(node.Pipe, dot); err != nil {
+		return err
+	}
+	if err := f.check(node.List, inner); err != nil {
+		return err
+	}
+	return f.check(node.ElseList, dot)
+}
+
+// checkPipe checks all arguments of the pipeline and returns the type of its
+// value if it is a single field reference
+func (f fieldChecker) checkPipe(pipe *parse.PipeNode, dot reflect.Type) (reflect.Type, error) {
+	if pipe == nil {
+		return nil, nil
+	}
+
+	var result reflect.Type
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			t, err := f.checkArg(arg, dot)
+			if err != nil {
+				return nil, err
+			}
+			if len(pipe.Cmds) == 1 && len(cmd.Args) == 1 {
+				result = t
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (f fieldChecker) checkArg(arg parse.Node, dot reflect.Type) (reflect.Type, error) {
+	switch arg := arg.(type) {
+	case *parse.DotNode:
+		return dot, nil
+	case *parse.FieldNode:
+		return f.resolve(arg, dot, arg.Ident)
+	case *parse.VariableNode:
+		// Only $ is known, it is the root context
+		if arg.Ident[0] == "$" {
+			return f.resolve(arg, f.root, arg.Ident[1:])
+		}
+	case *parse.ChainNode:
+		_, err := f.checkArg(arg.Node, dot)
+		return nil, err
+	case *parse.PipeNode:
+		return f.checkPipe(arg, dot)
+	}
+
+	return nil, nil
+}
+
+func (f fieldChecker) resolve(node parse.Node, t reflect.Type, fields []string) (reflect.Type, error) {
+	for _, field := range fields {
+		if t == nil {
+			return nil, nil
+		}
+
+		switch t.Kind() {
+		case reflect.Struct:
+			structField, ok := t.FieldByName(field)
+			if !ok {
+				location, _ := f.tmpl.ErrorContext(node)
+				return nil, fmt.Errorf("%s: unknown variable .%s", location, field)
+			}
+			t = structField.Type
+		case reflect.Map:
+			// Any key can be read, e.g. {{ .Env.NODE_ENV }}
+			t = t.Elem()
+		default:
+			location, _ := f.tmpl.ErrorContext(node)
+			return nil, fmt.Errorf("%s: can not read .%s of %s", location, field, t)
+		}
+	}
+
+	return t, nil
+}
+
+// formatEnv formats env as KEY=VALUE lines
+func formatEnv(env map[string]string) *string {
+	if len(env) == 0 {
+		return nil
+	}
+
+	lines := lo.MapToSlice(env, func(key, value string) string {
+		return fmt.Sprintf("%s=%s", key, value)
+	})
+	sort.Strings(lines)
+
+	return ptr(strings.Join(lines, "\n"))
+}
+
+// parseEnv parses KEY=VALUE lines
+func parseEnv(env *string) map[string]string {
+	vars := make(map[string]string)
+	if env == nil {
+		return vars
+	}
+
+	for _, line := range strings.Split(*env, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		vars[key] = value
+	}
+
+	return vars
+}
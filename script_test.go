@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestValidateScript(t *testing.T) {
+	tests := []struct {
+		source  string
+		wantErr bool
+	}{
+		{"{{ .PackageManager }} install", false},
+		{"%pm% run build", false},
+		{"{{ .Env.NODE_ENV }}", false},
+		{`{{ index .Env "NODE_ENV" }}`, false},
+		{`{{ default "3000" .Port }}`, false},
+		{"{{ $.App.Slug }}", false},
+		{"{{ with .Deployment }}{{ .Slug }}{{ end }}", false},
+		{"{{ range $key, $value := .Env }}{{ $key }}={{ $value }}{{ end }}", false},
+		{"{{ .Unknown }}", true},
+		{"{{ .App.Unknown }}", true},
+		{"{{ $.Deployment.Unknown }}", true},
+		// Branches that are not taken are checked as well
+		{`{{ if eq .Branch "main" }}{{ .Brnch }}{{ end }}`, true},
+		{"{{ with .App }}{{ .Slg }}{{ end }}", true},
+		{"{{ range .Env }}{{ .Name }}{{ end }}", true},
+		{"{{ .Commit.Short }}", true},
+		{"{{ unknownFunc }}", true},
+		{"{{ .PackageManager", true},
+	}
+
+	for _, test := range tests {
+		err := validateScript("test", test.source)
+		if (err != nil) != test.wantErr {
+			t.Errorf("validateScript(%q) = %v, want error: %v", test.source, err, test.wantErr)
+		}
+	}
+}
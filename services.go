@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/samber/lo"
+)
+
+var ErrServiceFailed = errors.New("Service failed")
+
+// Service names are used as hostnames and env prefixes
+var serviceNameRegex = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+const (
+	defaultServiceTimeout  = time.Minute
+	defaultServiceInterval = time.Second
+	// Timeout of a single healthcheck run
+	serviceCheckTimeout = 10 * time.Second
+)
+
+// Service is a sidecar container (e.g. a database) that is started with every
+// deployment on the app network and removed with it. Declared in templates as
+// [services.<name>] or set per app
+type Service struct {
+	Image      string            `toml:"image"       json:"image"`
+	PullPolicy string            `toml:"pull_policy" json:"pull_policy"`
+	Port       string            `toml:"port"        json:"port"`
+	Env        map[string]string `toml:"env"         json:"env"`
+	// Command run inside the service until it exits with 0, e.g. pg_isready.
+	// Without a healthcheck the port is checked using TCP
+	Healthcheck string `toml:"healthcheck" json:"healthcheck"`
+	Timeout     string `toml:"timeout"     json:"timeout"`
+	// Script run inside the service once it is healthy, e.g. to create a
+	// database or load seed data
+	Init string `toml:"init" json:"init"`
+	// Env added to the app. Values are templates with .Host, .Port and
+	// .Env, e.g. postgres://{{ .Host }}:{{ .Port }}/app
+	Expose map[string]string `toml:"expose" json:"expose"`
+}
+
+// ServiceContainer is a started service of a deployment
+type ServiceContainer struct {
+	Name        string `json:"name"`
+	ContainerId string `json:"container_id"`
+	// Hostname of the service on the app network
+	Host string `json:"host"`
+}
+
+// ServiceContext is available in the expose templates of services
+type ServiceContext struct {
+	Host string
+	Port string
+	Env  map[string]string
+}
+
+func (s Service) GetPullPolicy() string {
+	if s.PullPolicy != "" {
+		return s.PullPolicy
+	}
+	return pullPolicy
+}
+
+func (s Service) GetTimeout() (time.Duration, error) {
+	return parseProbeDuration(s.Timeout, defaultServiceTimeout)
+}
+
+func (s Service) GetPort() string {
+	return strings.Split(s.Port, "/")[0]
+}
+
+func (s Service) Validate() error {
+	if s.Image == "" {
+		return errors.New("image is required")
+	}
+	if s.PullPolicy != "" && !isValidPullPolicy(s.PullPolicy) {
+		return fmt.Errorf("invalid pull_policy: %s", s.PullPolicy)
+	}
+	if _, err := s.GetTimeout(); err != nil {
+		return fmt.Errorf("timeout: %w", err)
+	}
+
+	ctx := ServiceContext{Host: "service", Port: s.GetPort(), Env: s.Env}
+	for name, value := range s.Expose {
+		if _, err := renderServiceValue(name, value, ctx); err != nil {
+			return fmt.Errorf("expose.%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func validateServices(services map[string]Service) error {
+	for name, service := range services {
+		if !serviceNameRegex.MatchString(name) {
+			return fmt.Errorf("services: invalid name: %s", name)
+		}
+		if err := service.Validate(); err != nil {
+			return fmt.Errorf("services.%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func renderServiceValue(name, source string, ctx ServiceContext) (string, error) {
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(scriptFuncs).
+		Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	var value strings.Builder
+	err = tmpl.Execute(&value, ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return value.String(), nil
+}
+
+// getServices returns the services of the template with the app services
+// added. App services replace template services of the same name. Static
+// deployments have no container that could use them
+func (d *Deployment) getServices(template TemplateConfig) map[string]Service {
+	if template.Run.IsStatic() {
+		return nil
+	}
+	return lo.Assign(template.Services, d.App.Services)
+}
+
+// getServiceHost returns the hostname of the service on the app network. It
+// includes the deployment id, since all deployments of the app share the
+// network
+func (d *Deployment) getServiceHost(name string) string {
+	return fmt.Sprintf("%s-%s", name, strings.ToLower(d.Id))
+}
+
+// getServiceEnv returns the connection details of the started services:
+// <NAME>_HOST, <NAME>_PORT and the exposed env of every service
+func (d *Deployment) getServiceEnv(template TemplateConfig) map[string]string {
+	env := make(map[string]string)
+	services := d.getServices(template)
+
+	for _, instance := range d.Services {
+		service, ok := services[instance.Name]
+		if !ok {
+			continue
+		}
+
+		prefix := strings.ToUpper(strings.ReplaceAll(instance.Name, "-", "_"))
+		env[prefix+"_HOST"] = instance.Host
+		if service.Port != "" {
+			env[prefix+"_PORT"] = service.GetPort()
+		}
+
+		ctx := ServiceContext{Host: instance.Host, Port: service.GetPort(), Env: service.Env}
+		for name, source := range service.Expose {
+			value, err := renderServiceValue(name, source, ctx)
+			if err != nil {
+				log.Println("[Services]", err)
+				continue
+			}
+			env[name] = value
+		}
+	}
+
+	return env
+}
+
+// StartServices starts the services of the deployment and waits until they
+// are healthy. Existing service containers are started again, e.g. after the
+// deployment was stopped
+func (d *Deployment) StartServices(template TemplateConfig, buildLog *LogFile) (err error) {
+	services := d.getServices(template)
+	if len(services) == 0 {
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%w: %s", ErrServiceFailed, err)
+		}
+	}()
+
+	networkName, err := d.App.ensureNetwork()
+	if err != nil {
+		return
+	}
+
+	// Start in a stable order, so logs are comparable between deployments
+	names := lo.Keys(services)
+	sort.Strings(names)
+
+	for _, name := range names {
+		service := services[name]
+
+		instance, found := lo.Find(d.Services, func(s ServiceContainer) bool {
+			return s.Name == name
+		})
+		if found {
+			buildLog.Printf("Starting service %s", name)
+			err = dockerStart(instance.ContainerId)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		} else {
+			instance, err = d.runService(name, service, networkName, buildLog)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		err = d.waitServiceHealthy(instance, service, networkName, buildLog)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		// Init scripts only run once, not on every start
+		if !found && service.Init != "" {
+			buildLog.Printf("Running init script of service %s", name)
+			exitCode, execErr := dockerExec(
+				instance.ContainerId,
+				[]string{"/bin/sh", "-c", service.Init},
+				buildLog,
+			)
+			if execErr != nil {
+				return fmt.Errorf("%s: %w", name, execErr)
+			}
+			if exitCode != 0 {
+				return fmt.Errorf("%s: init script exited with code %d", name, exitCode)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *Deployment) runService(
+	name string,
+	service Service,
+	networkName string,
+	buildLog *LogFile,
+) (instance ServiceContainer, err error) {
+	imageDigest, err := dockerEnsureImage(service.Image, service.GetPullPolicy(), buildLog)
+	if err != nil {
+		return
+	}
+
+	host := d.getServiceHost(name)
+	labels := d.containerLabels(RoleService)
+	labels[labelService] = name
+
+	buildLog.Printf("Starting service %s using image: %s", name, service.Image)
+	containerId, err := dockerRun(ContainerSpec{
+		Image:   imageDigest,
+		Env:     formatEnv(service.Env),
+		Labels:  labels,
+		Network: networkName,
+		Aliases: []string{host},
+	})
+	if containerId != "" {
+		// Recorded even if the start failed, so Destroy removes the container
+		instance = ServiceContainer{Name: name, ContainerId: containerId, Host: host}
+		d.Services = append(d.Services, instance)
+	}
+
+	return
+}
+
+// waitServiceHealthy runs the healthcheck of the service, or checks its port,
+// until it succeeds
+func (d *Deployment) waitServiceHealthy(
+	instance ServiceContainer,
+	service Service,
+	networkName string,
+	buildLog *LogFile,
+) error {
+	timeout, err := service.GetTimeout()
+	if err != nil {
+		return err
+	}
+
+	check := func() error {
+		running, exitCode, _, err := inspectExit(instance.ContainerId)
+		if err != nil {
+			return err
+		}
+		if !running {
+			return fmt.Errorf("container exited with code %d", exitCode)
+		}
+
+		if service.Healthcheck != "" {
+			// A hanging healthcheck must not block past the deadline
+			ctx, cancel := context.WithTimeout(context.Background(), serviceCheckTimeout)
+			defer cancel()
+
+			exitCode, err := dockerExecContext(
+				ctx,
+				instance.ContainerId,
+				[]string{"/bin/sh", "-c", service.Healthcheck},
+				io.Discard,
+			)
+			if err != nil {
+				return err
+			}
+			if exitCode != 0 {
+				return fmt.Errorf("healthcheck exited with code %d", exitCode)
+			}
+			return nil
+		}
+
+		if service.Port != "" {
+			ip, err := dockerContainerIP(instance.ContainerId, networkName)
+			if err != nil {
+				return err
+			}
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, service.GetPort()), probeRequestTimeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = check()
+		if err == nil {
+			buildLog.Printf("Service %s is healthy", instance.Name)
+			return nil
+		}
+
+		// Exited services never become healthy
+		if running, _, _, inspectErr := inspectExit(instance.ContainerId); inspectErr == nil && !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(defaultServiceInterval)
+	}
+
+	if logs, logsErr := dockerLogs(instance.ContainerId); logsErr == nil {
+		buildLog.Printf("Last logs of service %s:\n%s", instance.Name, tailLines(logs, 20))
+	}
+	return err
+}
+
+// StopServices stops the service containers of the deployment. Their data is
+// kept until the deployment is destroyed
+func (d *Deployment) StopServices() {
+	for _, instance := range d.Services {
+		err := dockerStop(instance.ContainerId)
+		if err != nil && !client.IsErrNotFound(err) {
+			log.Println("[Services]", err)
+		}
+	}
+}
+
+// removeServices removes the service containers and their anonymous volumes
+func (d *Deployment) removeServices() {
+	for _, instance := range d.Services {
+		dockerStop(instance.ContainerId)
+		err := dockerRemove(instance.ContainerId)
+		if err != nil && !client.IsErrNotFound(err) {
+			log.Println("[Services]", err)
+		}
+	}
+	d.Services = nil
+}
+
+// RunServices starts the services of a built deployment before hooks and the
+// run container, so both can connect to them
+func (d *Deployment) RunServices() (err error) {
+	template, err := d.getTemplate()
+	if err != nil {
+		return
+	}
+	if len(d.getServices(template)) == 0 {
+		return nil
+	}
+
+	buildLog, err := d.openBuildLog()
+	if err != nil {
+		return
+	}
+	defer buildLog.Close()
+
+	err = d.StartServices(template, buildLog)
+	if err != nil {
+		buildLog.Printf("Deployment failed: %s", err)
+		d.StopServices()
+		d.SetState(StateFailed, err.Error())
+		writeConfig()
+	}
+
+	return
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Requests that do not get the waking page are held at most this long
+const wakeHoldTimeout = 2 * time.Minute
+
+// Shown to browsers while a sleeping deployment is started again
+const wakingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>Waking up</title>
+<style>body{font-family:sans-serif;display:flex;height:100vh;margin:0;align-items:center;justify-content:center;color:#555}</style>
+</head>
+<body><p>This preview was sleeping and is waking up. The page reloads automatically&hellip;</p></body>
+</html>`
+
+// GetIdleTimeout returns how long a deployment may be idle before its run
+// container is stopped, falling back to the global -idle-timeout flag. 0
+// disables scale to zero
+func (s StepRun) GetIdleTimeout() (time.Duration, error) {
+	if s.IdleTimeout == "" {
+		return idleTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(s.IdleTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("must not be negative: %s", s.IdleTimeout)
+	}
+
+	return timeout, nil
+}
+
+// lastActivity returns the time of the last proxied request, or when the
+// deployment started running if it never received one
+func (d *Deployment) lastActivity() time.Time {
+	d.RequestsLogLock.Lock()
+	lastRequest := d.LastRequestAt
+	d.RequestsLogLock.Unlock()
+
+	lastStart, _ := d.lastTransitionTo(StateRunning)
+	if lastRequest.After(lastStart) {
+		return lastRequest
+	}
+	return lastStart
+}
+
+// recordRequest appends the request to the requests log and marks the
+// deployment as active
+func (d *Deployment) recordRequest(c *fiber.Ctx) {
+	d.RequestsLogLock.Lock()
+	defer d.RequestsLogLock.Unlock()
+
+	d.RequestsLog = append(
+		d.RequestsLog,
+		fmt.Sprintf("%s %s %d", c.Method(), c.Path(), c.Response().StatusCode()),
+	)
+	d.LastRequestAt = time.Now()
+}
+
+// watchIdleDeployments stops the run containers of deployments that did not
+// receive requests within their idle timeout
+func watchIdleDeployments() {
+	for {
+		time.Sleep(time.Minute)
+
+		for _, deployment := range getAllDeployments() {
+			if deployment.GetStatus() != StateRunning || deployment.ContainerId == nil {
+				continue
+			}
+
+			template, err := deployment.getTemplate()
+			if err != nil || template.Run.IsStatic() {
+				continue
+			}
+			timeout, err := template.Run.GetIdleTimeout()
+			if err != nil || timeout == 0 {
+				continue
+			}
+
+			if time.Since(deployment.lastActivity()) < timeout {
+				continue
+			}
+
+			err = deployment.Sleep()
+			if err != nil {
+				log.Println("[Idle]", deployment.GetSlug(), err)
+			}
+		}
+	}
+}
+
+// Sleep stops the run container of an idle deployment. It is started again
+// on the next request
+func (d *Deployment) Sleep() error {
+	// Set state first, so the crash watcher ignores the stopped container
+	err := d.SetState(StateSleeping, "Idle")
+	if err != nil {
+		return err
+	}
+	writeConfig()
+
+	err = dockerStop(*d.ContainerId)
+	d.StopServices()
+	return err
+}
+
+type wakeup struct {
+	done chan struct{}
+	err  error
+}
+
+// Wakeups in progress by deployment id. Concurrent requests share a wakeup
+var wakeups = make(map[string]*wakeup)
+var wakeupsLock sync.Mutex
+
+func (d *Deployment) isWaking() bool {
+	wakeupsLock.Lock()
+	defer wakeupsLock.Unlock()
+
+	_, ok := wakeups[d.Id]
+	return ok
+}
+
+// Wake starts the run container of a sleeping deployment in the background.
+// The returned wakeup is done once the readiness probe passed
+func (d *Deployment) Wake() *wakeup {
+	wakeupsLock.Lock()
+	defer wakeupsLock.Unlock()
+
+	if w, ok := wakeups[d.Id]; ok {
+		return w
+	}
+
+	w := &wakeup{done: make(chan struct{})}
+	wakeups[d.Id] = w
+
+	go func() {
+		w.err = d.wake()
+		if w.err != nil {
+			log.Println("[Idle]", d.GetSlug(), w.err)
+		}
+
+		wakeupsLock.Lock()
+		delete(wakeups, d.Id)
+		wakeupsLock.Unlock()
+		close(w.done)
+	}()
+
+	return w
+}
+
+func (d *Deployment) wake() error {
+	// Woken up by a previous request
+	if d.GetStatus() == StateRunning {
+		return nil
+	}
+
+	return d.Start("Request while sleeping")
+}
+
+// serveWaking wakes up a sleeping deployment. Browsers get a page that reloads
+// until the deployment is ready (handled), other requests are held until then
+// and can be proxied afterwards
+func (d *Deployment) serveWaking(c *fiber.Ctx) (handled bool, err error) {
+	w := d.Wake()
+
+	if c.Method() == fiber.MethodGet && strings.Contains(c.Get(fiber.HeaderAccept), fiber.MIMETextHTML) {
+		c.Set(fiber.HeaderRetryAfter, "2")
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		c.Type("html")
+		return true, c.Status(fiber.StatusServiceUnavailable).SendString(wakingPage)
+	}
+
+	select {
+	case <-w.done:
+	case <-time.After(wakeHoldTimeout):
+		return true, fiber.NewError(fiber.StatusGatewayTimeout, "Deployment is still waking up")
+	}
+
+	if w.err != nil {
+		return true, fiber.NewError(fiber.StatusBadGateway, fmt.Sprintf("Failed to wake up deployment: %s", w.err))
+	}
+	return false, nil
+}
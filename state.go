@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+type DeploymentState string
+
+// Error states start with "Error" so the UI can highlight them
+const (
+	StatePending         DeploymentState = "Pending"
+	StateBuilding        DeploymentState = "Building"
+	StateBuilt           DeploymentState = "Built"
+	StateRunningHooks    DeploymentState = "Running Hooks"
+	StateStarting        DeploymentState = "Starting"
+	StateRunning         DeploymentState = "Running"
+	StateStopped         DeploymentState = "Stopped"
+	StateSleeping        DeploymentState = "Sleeping"
+	StateBuildFailed     DeploymentState = "Error: Build Failed"
+	StateImagePullFailed DeploymentState = "Error: Image Pull Failed"
+	StateHookFailed      DeploymentState = "Error: Hook Failed"
+	StateOOMKilled       DeploymentState = "Error: OOM Killed"
+	StateProbeFailed     DeploymentState = "Error: Readiness Probe Failed"
+	StateCrashed         DeploymentState = "Error: Crashed"
+	StateFailed          DeploymentState = "Failed"
+)
+
+// Allowed deployment state transitions
+var stateTransitions = map[DeploymentState][]DeploymentState{
+	// Built directly when the artifact of another deployment is reused
+	StatePending: {StateBuilding, StateBuilt, StateFailed},
+	StateBuilding: {
+		StateBuilt,
+		StateBuildFailed,
+		StateImagePullFailed,
+		StateOOMKilled,
+		StateFailed,
+	},
+	StateBuilt: {StateRunningHooks, StateStarting, StateFailed},
+	StateRunningHooks: {
+		StateStarting,
+		StateHookFailed,
+		StateImagePullFailed,
+		StateOOMKilled,
+		StateFailed,
+	},
+	StateStarting: {
+		StateRunning,
+		StateProbeFailed,
+		StateCrashed,
+		StateHookFailed,
+		StateImagePullFailed,
+		StateOOMKilled,
+		StateFailed,
+	},
+	StateRunning: {StateStopped, StateSleeping, StateCrashed, StateOOMKilled, StateFailed},
+	// Woken up by the next request
+	StateSleeping: {StateStarting, StateStopped, StateFailed},
+	// Started using the API
+	StateStopped: {StateStarting, StateFailed},
+	// Restarted according to the restart policy
+	StateCrashed:   {StateStarting, StateStopped, StateFailed},
+	StateOOMKilled: {StateStarting, StateStopped, StateFailed},
+}
+
+type BuildStatus string
+
+// Error statuses are named like the deployment states they lead to
+const (
+	BuildRunning         BuildStatus = "Building"
+	BuildSuccess         BuildStatus = "Success"
+	BuildFailed          BuildStatus = "Failed"
+	BuildImagePullFailed BuildStatus = BuildStatus(StateImagePullFailed)
+	BuildOOMKilled       BuildStatus = BuildStatus(StateOOMKilled)
+)
+
+type StateTransition struct {
+	From   DeploymentState `json:"from"`
+	To     DeploymentState `json:"to"`
+	Reason string          `json:"reason"`
+	Time   time.Time       `json:"time"`
+}
+
+// failureState maps an error onto the matching error state
+func failureState(err error, fallback DeploymentState) DeploymentState {
+	var pullErr *ImagePullError
+	switch {
+	case errors.As(err, &pullErr):
+		return StateImagePullFailed
+	case errors.Is(err, ErrOOMKilled):
+		return StateOOMKilled
+	case errors.Is(err, ErrHookFailed):
+		return StateHookFailed
+	case errors.Is(err, ErrProbeFailed):
+		return StateProbeFailed
+	}
+	return fallback
+}
+
+func canTransition(from, to DeploymentState) bool {
+	return lo.Contains(stateTransitions[from], to)
+}
+
+// SetState moves the deployment into a new state and records the transition
+// in its timeline. Returns an error for transitions the state machine does
+// not allow
+func (d *Deployment) SetState(to DeploymentState, reason string) error {
+	_, err := d.swapState(nil, to, reason)
+	return err
+}
+
+// swapState works like SetState, but only moves the deployment if it is in
+// one of the states in from (any state if from is empty). Returns the state
+// it was in, checked and changed under the lock
+func (d *Deployment) swapState(from []DeploymentState, to DeploymentState, reason string) (DeploymentState, error) {
+	d.StateLock.Lock()
+	defer d.StateLock.Unlock()
+
+	previous := d.Status
+	if len(from) > 0 && !lo.Contains(from, previous) {
+		return previous, fmt.Errorf("Deployment is %s, not moving to %s", previous, to)
+	}
+	if !canTransition(previous, to) {
+		return previous, fmt.Errorf("Invalid deployment state transition: %s -> %s", previous, to)
+	}
+
+	d.recordState(to, reason)
+	return previous, nil
+}
+
+// GetStatus returns the current state. It changes while the deployment is
+// built and run, so it must not be read directly
+func (d *Deployment) GetStatus() DeploymentState {
+	d.StateLock.Lock()
+	defer d.StateLock.Unlock()
+
+	return d.Status
+}
+
+// GetTimeline returns a copy of the state transitions
+func (d *Deployment) GetTimeline() []StateTransition {
+	d.StateLock.Lock()
+	defer d.StateLock.Unlock()
+
+	return append([]StateTransition(nil), d.Timeline...)
+}
+
+func (d *Deployment) recordState(to DeploymentState, reason string) {
+	d.Timeline = append(d.Timeline, StateTransition{
+		From:   d.Status,
+		To:     to,
+		Reason: reason,
+		Time:   time.Now(),
+	})
+	d.Status = to
+
+	log.Printf("[Deployment] %s: %s (%s)", d.GetSlug(), to, reason)
+}
+
+// restoreState fixes up the state after loading apps.json. Deployments that
+// were in progress when runner stopped can not be continued
+func (d *Deployment) restoreState() {
+	switch d.Status {
+	case StateRunning, StateStopped, StateSleeping, StateCrashed, StateOOMKilled:
+		return
+	}
+
+	_, inProgress := stateTransitions[d.Status]
+	final := !inProgress && lo.Contains(lo.Flatten(lo.Values(stateTransitions)), d.Status)
+	if final {
+		return
+	}
+
+	d.recordState(StateFailed, "Interrupted by runner restart")
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to DeploymentState
+		want     bool
+	}{
+		{StatePending, StateBuilding, true},
+		{StatePending, StateBuilt, true},
+		{StatePending, StateRunning, false},
+		{StateBuilding, StateBuilt, true},
+		{StateBuilding, StateBuildFailed, true},
+		{StateBuilt, StateRunningHooks, true},
+		{StateBuilt, StateStarting, true},
+		{StateBuilt, StateRunning, false},
+		{StateRunningHooks, StateHookFailed, true},
+		{StateStarting, StateRunning, true},
+		{StateStarting, StateProbeFailed, true},
+		{StateRunning, StateStopped, true},
+		{StateRunning, StateSleeping, true},
+		{StateRunning, StateCrashed, true},
+		{StateRunning, StateStarting, false},
+		{StateSleeping, StateStarting, true},
+		{StateStopped, StateStarting, true},
+		{StateStopped, StateCrashed, false},
+		{StateCrashed, StateStarting, true},
+		{StateOOMKilled, StateStopped, true},
+		// Final states
+		{StateFailed, StateStarting, false},
+		{StateBuildFailed, StateBuilding, false},
+		{StateProbeFailed, StateStarting, false},
+	}
+
+	for _, test := range tests {
+		if got := canTransition(test.from, test.to); got != test.want {
+			t.Errorf("canTransition(%q, %q) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultStaticCacheControl = "public, max-age=3600"
+
+// getStaticRoot returns the directory served for static deployments
+func (d *Deployment) getStaticRoot(template TemplateConfig) string {
+	return path.Join(d.BuildJob.ArtifactsPath, template.Build.Artifact)
+}
+
+// ServeStatic serves the request from the artifact directory of a static
+// deployment
+func (d *Deployment) ServeStatic(c *fiber.Ctx, template TemplateConfig) error {
+	if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+		return fiber.NewError(fiber.StatusMethodNotAllowed, "Method not allowed")
+	}
+
+	root, err := filepath.Abs(d.getStaticRoot(template))
+	if err != nil {
+		return err
+	}
+
+	status := fiber.StatusOK
+	file, err := resolveStaticFile(root, c.Path())
+	if err != nil {
+		switch {
+		case template.Run.Spa:
+			file, err = resolveStaticFile(root, "/index.html")
+		case template.Run.NotFound != "":
+			status = fiber.StatusNotFound
+			file, err = resolveStaticFile(root, template.Run.NotFound)
+		}
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusNotFound, "Not found")
+	}
+
+	// HTML references the (possibly changed) assets and must be revalidated
+	cacheControl := template.Run.CacheControl
+	if cacheControl == "" {
+		cacheControl = defaultStaticCacheControl
+	}
+	if strings.HasSuffix(file, ".html") {
+		cacheControl = "no-cache"
+	}
+	c.Set(fiber.HeaderCacheControl, cacheControl)
+
+	c.Status(status)
+	return c.SendFile(file)
+}
+
+// resolveStaticFile maps the request path to a regular file inside root.
+// Directories are served by their index.html
+func resolveStaticFile(root, requestPath string) (string, error) {
+	file := filepath.Join(root, filepath.FromSlash(path.Clean("/"+requestPath)))
+
+	info, err := os.Stat(file)
+	if err == nil && info.IsDir() {
+		file = filepath.Join(file, "index.html")
+		info, err = os.Stat(file)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("Not a file: %s", requestPath)
+	}
+
+	// Symlinks in the artifact must not point outside of it
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", err
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+		return "", errors.New("File is outside of the artifact")
+	}
+
+	return resolved, nil
+}
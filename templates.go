@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/samber/lo"
+)
+
+const templatesDir = "./templates"
+
+var templateIdRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Guards deploymentTemplates and templateErrors, both are replaced on reload
+var templatesLock sync.RWMutex
+
+// Per file error of templates that could not be loaded
+var templateErrors map[string]string
+
+func getTemplatePath(id string) string {
+	return path.Join(templatesDir, fmt.Sprintf("%s.toml", id))
+}
+
+func getTemplate(id string) (TemplateConfig, bool) {
+	templatesLock.RLock()
+	defer templatesLock.RUnlock()
+
+	template, ok := deploymentTemplates[id]
+	return template, ok
+}
+
+func getTemplates() map[string]TemplateConfig {
+	templatesLock.RLock()
+	defer templatesLock.RUnlock()
+
+	return lo.Assign(deploymentTemplates)
+}
+
+func getTemplateErrors() map[string]string {
+	templatesLock.RLock()
+	defer templatesLock.RUnlock()
+
+	return lo.Assign(templateErrors)
+}
+
+// loadTemplates (re)loads all templates. Invalid files are reported in
+// templateErrors. If a previously valid template becomes invalid, the last
+// valid version is kept until the file is fixed
+func loadTemplates() {
+	templates := make(map[string]TemplateConfig)
+	errs := make(map[string]string)
+
+	sources, sourceErrs := loadTemplateSources()
+	for id, err := range sourceErrs {
+		errs[id] = err.Error()
+	}
+
+	for id := range sources {
+		config, err := resolveTemplate(id, sources)
+		if err != nil {
+			errs[id] = err.Error()
+			continue
+		}
+		templates[id] = config
+	}
+
+	previous := getTemplates()
+	for id, err := range errs {
+		log.Printf("[Templates] %s: %s", getTemplatePath(id), err)
+
+		if old, ok := previous[id]; ok {
+			templates[id] = old
+		}
+	}
+
+	templatesLock.Lock()
+	deploymentTemplates = templates
+	templateErrors = errs
+	templatesLock.Unlock()
+}
+
+// loadTemplateSources reads all template files as raw TOML tables
+func loadTemplateSources() (map[string]map[string]any, map[string]error) {
+	sources := make(map[string]map[string]any)
+	errs := make(map[string]error)
+
+	matches, err := filepath.Glob(path.Join(templatesDir, "*.toml"))
+	if err != nil {
+		log.Println("[Templates]", err)
+		return sources, errs
+	}
+
+	for _, file := range matches {
+		id := strings.TrimSuffix(filepath.Base(file), ".toml")
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+
+		source := make(map[string]any)
+		_, err = toml.Decode(string(data), &source)
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+
+		sources[id] = source
+	}
+
+	return sources, errs
+}
+
+// parseTemplate parses and validates the source of template id. Other
+// templates are read from disk to resolve extends
+func parseTemplate(id string, source []byte) (TemplateConfig, error) {
+	table := make(map[string]any)
+	_, err := toml.Decode(string(source), &table)
+	if err != nil {
+		return TemplateConfig{}, err
+	}
+
+	sources, _ := loadTemplateSources()
+	sources[id] = table
+
+	return resolveTemplate(id, sources)
+}
+
+// resolveTemplate merges the template with all templates it extends and
+// validates the result
+func resolveTemplate(id string, sources map[string]map[string]any) (TemplateConfig, error) {
+	table, err := resolveTemplateTable(id, sources, nil)
+	if err != nil {
+		return TemplateConfig{}, err
+	}
+
+	return decodeTemplate(table)
+}
+
+func resolveTemplateTable(
+	id string,
+	sources map[string]map[string]any,
+	chain []string,
+) (map[string]any, error) {
+	if lo.Contains(chain, id) {
+		return nil, fmt.Errorf("Inheritance cycle: %s -> %s", strings.Join(chain, " -> "), id)
+	}
+	chain = append(chain, id)
+
+	source, ok := sources[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown template: %s", id)
+	}
+
+	parentId, ok := source["extends"]
+	if !ok {
+		return source, nil
+	}
+	parentIdStr, ok := parentId.(string)
+	if !ok {
+		return nil, errors.New("extends must be a string")
+	}
+
+	parent, err := resolveTemplateTable(parentIdStr, sources, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeTables(parent, source), nil
+}
+
+// mergeTables returns a deep copy of base with override merged on top.
+// Only tables are merged, all other values are replaced
+func mergeTables(base, override map[string]any) map[string]any {
+	merged := make(map[string]any)
+
+	for key, value := range base {
+		if table, ok := value.(map[string]any); ok {
+			value = mergeTables(table, nil)
+		}
+		merged[key] = value
+	}
+
+	for key, value := range override {
+		overrideTable, ok := value.(map[string]any)
+		baseTable, baseOk := merged[key].(map[string]any)
+		if ok && baseOk {
+			merged[key] = mergeTables(baseTable, overrideTable)
+		} else {
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
+
+// decodeTemplate converts a raw TOML table into a validated template
+func decodeTemplate(table map[string]any) (config TemplateConfig, err error) {
+	var buf strings.Builder
+	err = toml.NewEncoder(&buf).Encode(table)
+	if err != nil {
+		return
+	}
+
+	meta, err := toml.Decode(buf.String(), &config)
+	if err != nil {
+		return
+	}
+
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := lo.Map(undecoded, func(key toml.Key, _ int) string {
+			return key.String()
+		})
+		return config, fmt.Errorf("Unknown fields: %s", strings.Join(keys, ", "))
+	}
+
+	err = validateTemplate(config)
+	return
+}
+
+func validateTemplate(config TemplateConfig) error {
+	if config.Name == "" {
+		return errors.New("name is required")
+	}
+	if config.Build.Image == "" {
+		return errors.New("build.image is required")
+	}
+	if config.Build.Artifact == "" {
+		return errors.New("build.artifact is required")
+	}
+	if !filepath.IsLocal(config.Build.Artifact) {
+		return fmt.Errorf("build.artifact must be a relative path inside the repository: %s", config.Build.Artifact)
+	}
+
+	if config.Build.Package != "" && config.Build.Package != PackageDirectory && config.Build.Package != PackageImage {
+		return fmt.Errorf("build.package: invalid value: %s", config.Build.Package)
+	}
+
+	err := validateRunStep(config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := config.Resources.ToDocker(); err != nil {
+		return fmt.Errorf("resources: %w", err)
+	}
+
+	if err := validateServices(config.Services); err != nil {
+		return err
+	}
+
+	for _, policy := range []string{config.Build.PullPolicy, config.Run.PullPolicy} {
+		if policy != "" && !isValidPullPolicy(policy) {
+			return fmt.Errorf("invalid pull_policy: %s", policy)
+		}
+	}
+
+	return validateScripts(config)
+}
+
+func validateRunStep(config TemplateConfig) error {
+	switch config.Run.Mode {
+	case "", RunContainer:
+		if config.Run.Image == "" {
+			return errors.New("run.image is required")
+		}
+		if config.Run.Port == "" {
+			return errors.New("run.port is required")
+		}
+		if config.Run.Spa || config.Run.NotFound != "" || config.Run.CacheControl != "" {
+			return errors.New("run.spa, run.not_found and run.cache_control require run.mode = \"static\"")
+		}
+		if err := config.Run.Readiness.Validate(); err != nil {
+			return fmt.Errorf("run.readiness: %w", err)
+		}
+		if err := config.Run.Restart.Validate(); err != nil {
+			return fmt.Errorf("run.restart: %w", err)
+		}
+		if _, err := config.Run.GetIdleTimeout(); err != nil {
+			return fmt.Errorf("run.idle_timeout: %w", err)
+		}
+
+	case RunStatic:
+		// Static files are served from the artifact directory
+		if config.Build.Package == PackageImage {
+			return errors.New("build.package = \"image\" is not supported by static deployments")
+		}
+		if config.Hooks.PostDeploy != "" {
+			return errors.New("hooks.post_deploy is not supported by static deployments")
+		}
+		if len(config.Services) > 0 {
+			return errors.New("services are not supported by static deployments")
+		}
+		if config.Hooks.PreDeploy != "" && config.Run.Image == "" {
+			return errors.New("hooks.pre_deploy requires run.image")
+		}
+		if config.Run.NotFound != "" && !filepath.IsLocal(config.Run.NotFound) {
+			return fmt.Errorf("run.not_found must be a relative path: %s", config.Run.NotFound)
+		}
+
+	default:
+		return fmt.Errorf("run.mode: invalid value: %s", config.Run.Mode)
+	}
+
+	return nil
+}
+
+// saveTemplate validates and writes the template source, then reloads all
+// templates
+func saveTemplate(id string, source []byte) error {
+	if !templateIdRegex.MatchString(id) {
+		return errors.New("Invalid template id")
+	}
+
+	_, err := parseTemplate(id, source)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(getTemplatePath(id), source, 0644)
+	if err != nil {
+		return err
+	}
+
+	loadTemplates()
+	return nil
+}
+
+func deleteTemplate(id string) error {
+	if !templateIdRegex.MatchString(id) {
+		return errors.New("Invalid template id")
+	}
+
+	usedBy := lo.Filter(apps, func(app *App, _ int) bool {
+		return app.TemplateId != nil && *app.TemplateId == id
+	})
+	if len(usedBy) > 0 {
+		names := lo.Map(usedBy, func(app *App, _ int) string {
+			return app.Name
+		})
+		return fmt.Errorf("Template is used by: %s", strings.Join(names, ", "))
+	}
+
+	children := lo.Keys(lo.PickBy(getTemplates(), func(_ string, t TemplateConfig) bool {
+		return t.Extends == id
+	}))
+	if len(children) > 0 {
+		return fmt.Errorf("Template is extended by: %s", strings.Join(children, ", "))
+	}
+
+	err := os.Remove(getTemplatePath(id))
+	if err != nil {
+		return err
+	}
+
+	loadTemplates()
+	return nil
+}
+
+// templatesSignature changes whenever a template file is added, removed or
+// modified
+func templatesSignature() string {
+	matches, _ := filepath.Glob(path.Join(templatesDir, "*.toml"))
+	sort.Strings(matches)
+
+	var signature strings.Builder
+	for _, file := range matches {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&signature, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return signature.String()
+}
+
+// watchTemplates polls the templates directory and reloads on changes
+func watchTemplates() {
+	signature := templatesSignature()
+
+	for {
+		time.Sleep(2 * time.Second)
+
+		current := templatesSignature()
+		if current == signature {
+			continue
+		}
+		signature = current
+
+		log.Println("[Templates] Change detected, reloading")
+		loadTemplates()
+	}
+}
@@ -0,0 +1,3 @@
+module runner/fixture
+
+go 1.21
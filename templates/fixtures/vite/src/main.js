@@ -0,0 +1 @@
+document.querySelector("#app").textContent = "Runner vite fixture";
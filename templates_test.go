@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeTables(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     map[string]any
+		override map[string]any
+		want     map[string]any
+	}{
+		{
+			name:     "nested tables are merged",
+			base:     map[string]any{"run": map[string]any{"image": "node:20", "port": "3000/tcp"}},
+			override: map[string]any{"run": map[string]any{"port": "8080/tcp"}},
+			want:     map[string]any{"run": map[string]any{"image": "node:20", "port": "8080/tcp"}},
+		},
+		{
+			name: "deeply nested tables are merged",
+			base: map[string]any{"run": map[string]any{"probe": map[string]any{"path": "/", "timeout": "1m"}}},
+			override: map[string]any{
+				"run": map[string]any{"probe": map[string]any{"path": "/health"}},
+			},
+			want: map[string]any{"run": map[string]any{"probe": map[string]any{"path": "/health", "timeout": "1m"}}},
+		},
+		{
+			name:     "arrays are replaced",
+			base:     map[string]any{"match_files": []any{"package.json", "vite.config.js"}},
+			override: map[string]any{"match_files": []any{"go.mod"}},
+			want:     map[string]any{"match_files": []any{"go.mod"}},
+		},
+		{
+			name:     "values replace tables",
+			base:     map[string]any{"env": map[string]any{"A": "1"}},
+			override: map[string]any{"env": "A=1"},
+			want:     map[string]any{"env": "A=1"},
+		},
+		{
+			name:     "keys are added",
+			base:     map[string]any{"name": "Base"},
+			override: map[string]any{"extends": "base", "hooks": map[string]any{"pre_deploy": "migrate"}},
+			want: map[string]any{
+				"name":    "Base",
+				"extends": "base",
+				"hooks":   map[string]any{"pre_deploy": "migrate"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := mergeTables(test.base, test.override)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: mergeTables() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeTablesCopiesBase(t *testing.T) {
+	base := map[string]any{"run": map[string]any{"port": "3000/tcp"}}
+	mergeTables(base, map[string]any{"run": map[string]any{"port": "8080/tcp"}})
+
+	if port := base["run"].(map[string]any)["port"]; port != "3000/tcp" {
+		t.Errorf("base was modified: run.port = %v", port)
+	}
+}
+
+func TestResolveTemplateTable(t *testing.T) {
+	sources := map[string]map[string]any{
+		"base": {
+			"name":  "Base",
+			"build": map[string]any{"image": "node:20", "script": "npm run build"},
+		},
+		"child": {
+			"extends": "base",
+			"name":    "Child",
+			"build":   map[string]any{"script": "npm run build:prod"},
+		},
+		"grandchild": {
+			"extends": "child",
+			"run":     map[string]any{"port": "8080/tcp"},
+		},
+		"orphan":  {"extends": "missing"},
+		"self":    {"extends": "self"},
+		"a":       {"extends": "b"},
+		"b":       {"extends": "c"},
+		"c":       {"extends": "a"},
+		"invalid": {"extends": 1},
+	}
+
+	tests := []struct {
+		id      string
+		want    map[string]any
+		wantErr string
+	}{
+		{id: "base", want: sources["base"]},
+		{
+			id: "grandchild",
+			want: map[string]any{
+				"extends": "child",
+				"name":    "Child",
+				"build":   map[string]any{"image": "node:20", "script": "npm run build:prod"},
+				"run":     map[string]any{"port": "8080/tcp"},
+			},
+		},
+		{id: "orphan", wantErr: "Unknown template: missing"},
+		{id: "unknown", wantErr: "Unknown template: unknown"},
+		{id: "self", wantErr: "Inheritance cycle: self -> self"},
+		{id: "a", wantErr: "Inheritance cycle: a -> b -> c -> a"},
+		{id: "invalid", wantErr: "extends must be a string"},
+	}
+
+	for _, test := range tests {
+		got, err := resolveTemplateTable(test.id, sources, nil)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("resolveTemplateTable(%q) error = %v, want %q", test.id, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveTemplateTable(%q) error = %v", test.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("resolveTemplateTable(%q) = %v, want %v", test.id, got, test.want)
+		}
+	}
+}
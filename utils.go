@@ -1,17 +1,17 @@
 package main
 
 import (
+	"archive/tar"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"net"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
-	"strings"
+	"sort"
 
-	"github.com/BurntSushi/toml"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/samber/lo"
 )
 
@@ -19,31 +19,45 @@ func ptr[T any](v T) *T {
 	return &v
 }
 
-func loadTemplates() {
-	// Load deployment templates
-	deploymentTemplates = make(map[string]TemplateConfig)
+// pullTemplateImages pre-loads all images referenced by templates, so runner
+// can operate with -pull-policy if-not-present or never afterwards
+func pullTemplateImages() error {
+	images := lo.Uniq(lo.FlatMap(lo.Values(getTemplates()), func(t TemplateConfig, _ int) []string {
+		images := []string{t.Build.Image, t.Run.Image}
+		for _, service := range t.Services {
+			images = append(images, service.Image)
+		}
+		return images
+	}))
+	// Used to copy volumes
+	images = lo.Uniq(append(images, volumeHelperImage))
 
-	matches, err := filepath.Glob("./templates/*.toml")
-	if err != nil {
-		log.Fatal(err)
+	for _, image := range images {
+		if err := dockerPull(image, os.Stdout); err != nil {
+			return err
+		}
 	}
 
-	for _, template := range matches {
-		var config TemplateConfig
+	return nil
+}
 
-		_, err := toml.DecodeFile(template, &config)
-		if err != nil {
-			log.Fatal(err)
+// Template ids ordered by priority (highest first), then id
+func getTemplateIdsByPriority() []string {
+	templates := getTemplates()
+	ids := lo.Keys(templates)
+	sort.Slice(ids, func(i, j int) bool {
+		if templates[ids[i]].Priority != templates[ids[j]].Priority {
+			return templates[ids[i]].Priority > templates[ids[j]].Priority
 		}
-
-		configKey := strings.TrimSuffix(filepath.Base(template), ".toml")
-		deploymentTemplates[configKey] = config
-	}
+		return ids[i] < ids[j]
+	})
+	return ids
 }
 
 func findTemplateByDependencies(deps map[string]string) (string, error) {
-	for key, value := range deploymentTemplates {
-		for _, dep := range value.MatchDependencies {
+	templates := getTemplates()
+	for _, key := range getTemplateIdsByPriority() {
+		for _, dep := range templates[key].MatchDependencies {
 			if _, ok := deps[dep]; ok {
 				return key, nil
 			}
@@ -53,6 +67,19 @@ func findTemplateByDependencies(deps map[string]string) (string, error) {
 	return "", errors.New("No template found")
 }
 
+func findTemplateByFiles(srcPath string) (string, error) {
+	templates := getTemplates()
+	for _, key := range getTemplateIdsByPriority() {
+		for _, file := range templates[key].MatchFiles {
+			if _, err := os.Stat(filepath.Join(srcPath, file)); err == nil {
+				return key, nil
+			}
+		}
+	}
+
+	return "", errors.New("No template found")
+}
+
 func loadPackageJSON(srcPath string) (map[string]interface{}, error) {
 	pkgB, err := os.ReadFile(filepath.Join(srcPath, "package.json"))
 	if err != nil {
@@ -70,35 +97,75 @@ func loadPackageJSON(srcPath string) (map[string]interface{}, error) {
 
 func parseDependencies(pkgJson map[string]interface{}) (map[string]string, error) {
 	deps := make(map[string]string)
-	switch v := pkgJson["dependencies"].(type) {
-	case map[string]interface{}:
-		for key, value := range v {
-			switch v2 := value.(type) {
-			case string:
-				deps[key] = v2
-				break
-			default:
-				return nil, errors.New(fmt.Sprintf("Package.json -> Dependencies -> Value: Must be a string. Got: %s", reflect.TypeOf(v2)))
+	for _, field := range []string{"dependencies", "devDependencies"} {
+		switch v := pkgJson[field].(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				switch v2 := value.(type) {
+				case string:
+					deps[key] = v2
+					break
+				default:
+					return nil, errors.New(fmt.Sprintf("Package.json -> %s -> Value: Must be a string. Got: %s", field, reflect.TypeOf(v2)))
+				}
 			}
+			break
+		case nil:
+			// Optional
+			break
+		default:
+			return nil, errors.New(fmt.Sprintf("Package.json -> %s: Must be a map[string]string. Got: %s", field, reflect.TypeOf(v)))
 		}
-		break
-	default:
-		return nil, errors.New(fmt.Sprintf("Package.json -> Dependencies: Must be a map[string]string. Got: %s", reflect.TypeOf(v)))
 	}
 
 	return deps, nil
 }
 
-func getFreePort() (port int, err error) {
-	var a *net.TCPAddr
-	if a, err = net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
-		var l *net.TCPListener
-		if l, err = net.ListenTCP("tcp", a); err == nil {
-			defer l.Close()
-			return l.Addr().(*net.TCPAddr).Port, nil
+// tarDirectory adds srcDir/subPath to the tar archive, keeping paths relative
+// to srcDir
+func tarDirectory(tw *tar.Writer, srcDir, subPath string) error {
+	return filepath.Walk(filepath.Join(srcDir, subPath), func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-	}
-	return
+
+		name, err := filepath.Rel(srcDir, file)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
 }
 
 func createDirIfNotExists(path string) error {
@@ -114,7 +181,7 @@ func createDirIfNotExists(path string) error {
 // TODO: check if we break references here
 func getAllDeployments() []*Deployment {
 	return lo.FlatMap(apps, func(app *App, index int) []*Deployment {
-		return apps[index].Deployments
+		return apps[index].GetDeployments()
 	})
 }
 
@@ -122,10 +189,32 @@ func getDeploymentByDomain(domain string) *Deployment {
 	deployment, found := lo.Find(getAllDeployments(), func(deployment *Deployment) bool {
 		return deployment.GetDomain() == domain
 	})
-	if !found {
-		return nil
+	if found {
+		return deployment
 	}
-	return deployment
+
+	if deployment := getDeploymentByAlias(domain); deployment != nil {
+		return deployment
+	}
+	return getDeploymentByAppDomain(domain)
+}
+
+// formatUrl returns the public url of a deployment domain
+func formatUrl(host string) string {
+	s := ""
+	p := ""
+	if ssl {
+		s = "s"
+		if sslPort != "443" {
+			p = fmt.Sprintf(":%s", sslPort)
+		}
+	} else {
+		if port != "80" {
+			p = fmt.Sprintf(":%s", port)
+		}
+
+	}
+	return fmt.Sprintf("http%s://%s%s", s, host, p)
 }
 
 func getAppById(id string) *App {
@@ -151,3 +240,21 @@ func getDeploymentById(id string) *Deployment {
 func makeId() string {
 	return lo.RandomString(12, lo.LettersCharset)
 }
+
+// isZeroCommit reports whether commit is the all zeros SHA git providers send
+// for deleted refs
+func isZeroCommit(commit string) bool {
+	return commit == plumbing.ZeroHash.String()
+}
+
+// parsePushRef returns the branch a push webhook refers to and whether it was
+// deleted. ok is false for deleted tags and other refs that are no branches
+func parsePushRef(ref, after string, deletedFlag bool) (branch string, deleted bool, ok bool) {
+	name := plumbing.ReferenceName(ref)
+	deleted = deletedFlag || isZeroCommit(after)
+	if deleted && !name.IsBranch() {
+		return "", false, false
+	}
+
+	return name.Short(), deleted, true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsZeroCommit(t *testing.T) {
+	tests := map[string]bool{
+		strings.Repeat("0", 40):                    true,
+		"0123456789abcdef0123456789abcdef01234567": false,
+		strings.Repeat("0", 39):                    false,
+		"":                                         false,
+	}
+
+	for commit, want := range tests {
+		if got := isZeroCommit(commit); got != want {
+			t.Errorf("isZeroCommit(%q) = %v, want %v", commit, got, want)
+		}
+	}
+}
+
+func TestParsePushRef(t *testing.T) {
+	zero := strings.Repeat("0", 40)
+	commit := "0123456789abcdef0123456789abcdef01234567"
+
+	tests := []struct {
+		name        string
+		ref         string
+		after       string
+		deletedFlag bool
+		wantBranch  string
+		wantDeleted bool
+		wantOk      bool
+	}{
+		{"push", "refs/heads/main", commit, false, "main", false, true},
+		{"push to nested branch", "refs/heads/feature/login", commit, false, "feature/login", false, true},
+		{"deleted branch", "refs/heads/main", zero, false, "main", true, true},
+		{"deleted flag", "refs/heads/main", commit, true, "main", true, true},
+		{"deleted tag", "refs/tags/v1", zero, true, "", false, false},
+		{"deleted tag without flag", "refs/tags/v1", zero, false, "", false, false},
+	}
+
+	for _, test := range tests {
+		branch, deleted, ok := parsePushRef(test.ref, test.after, test.deletedFlag)
+		if branch != test.wantBranch || deleted != test.wantDeleted || ok != test.wantOk {
+			t.Errorf(
+				"%s: parsePushRef() = %q, %v, %v, want %q, %v, %v",
+				test.name, branch, deleted, ok, test.wantBranch, test.wantDeleted, test.wantOk,
+			)
+		}
+	}
+}
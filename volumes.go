@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/samber/lo"
+)
+
+// Volume modes
+const (
+	VolumeShared = "shared"
+	VolumeCopy   = "copy"
+)
+
+// Labels of volumes created by runner, in addition to runner.app and
+// runner.deployment
+const (
+	labelVolume   = "runner.volume"
+	labelSnapshot = "runner.snapshot"
+)
+
+// Docker volume names join the parts with "-", so names must not contain it
+var volumeNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_]*$`)
+
+// Volume is a named docker volume mounted into the run and hook containers of
+// every deployment of the app
+type Volume struct {
+	Name string `json:"name"`
+	// Absolute mount path inside the containers
+	Path string `json:"path"`
+	// "shared" (default): all deployments mount the same volume. "copy": every
+	// deployment gets a copy of the volume of the current deployment of its
+	// branch, or of the app volume for new branches
+	Mode string `json:"mode"`
+	// Pause the running containers using the volume while it is copied, so
+	// copies and snapshots do not contain half written files. Paused
+	// deployments do not answer requests meanwhile
+	Pause bool `json:"pause"`
+}
+
+// VolumeInfo describes a docker volume of an app
+type VolumeInfo struct {
+	Name         string    `json:"name"`
+	Volume       string    `json:"volume"`
+	DeploymentId string    `json:"deployment_id,omitempty"`
+	Snapshot     string    `json:"snapshot,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (v Volume) GetMode() string {
+	if v.Mode == "" {
+		return VolumeShared
+	}
+	return v.Mode
+}
+
+func (v Volume) Validate() error {
+	if !volumeNameRegex.MatchString(v.Name) {
+		return fmt.Errorf("Invalid volume name: %s", v.Name)
+	}
+	if !path.IsAbs(v.Path) {
+		return fmt.Errorf("Volume path must be absolute: %s", v.Path)
+	}
+	if cleaned := path.Clean(v.Path); cleaned == "/" || cleaned == "/runner" || strings.HasPrefix(cleaned, "/runner/") {
+		return fmt.Errorf("Volume path is reserved: %s", v.Path)
+	}
+	if v.GetMode() != VolumeShared && v.GetMode() != VolumeCopy {
+		return fmt.Errorf("Invalid volume mode: %s", v.Mode)
+	}
+	return nil
+}
+
+// getVolumeName returns the docker volume shared by all deployments, which is
+// also the source of copies for new branches
+func (a *App) getVolumeName(name string) string {
+	return fmt.Sprintf("runner-%s-%s", strings.ToLower(a.Id), name)
+}
+
+func (a *App) findVolume(name string) (Volume, bool) {
+	return lo.Find(a.Volumes, func(v Volume) bool {
+		return v.Name == name
+	})
+}
+
+// SetVolume adds the volume or replaces the volume of the same name. Applies
+// to containers started afterwards
+func (a *App) SetVolume(v Volume) error {
+	err := v.Validate()
+	if err != nil {
+		return err
+	}
+
+	for _, other := range a.Volumes {
+		if other.Name != v.Name && path.Clean(other.Path) == path.Clean(v.Path) {
+			return fmt.Errorf("Path is already used by volume %s", other.Name)
+		}
+	}
+
+	a.Volumes = append(lo.Filter(a.Volumes, func(other Volume, _ int) bool {
+		return other.Name != v.Name
+	}), v)
+	return nil
+}
+
+// ListVolumes returns all docker volumes of the app, including deployment
+// copies and snapshots
+func (a *App) ListVolumes() ([]VolumeInfo, error) {
+	volumes, err := dockerListVolumes(map[string]string{labelApp: a.Id})
+	if err != nil {
+		return nil, err
+	}
+
+	infos := lo.Map(volumes, func(v *volume.Volume, _ int) VolumeInfo {
+		createdAt, _ := time.Parse(time.RFC3339, v.CreatedAt)
+		return VolumeInfo{
+			Name:         v.Labels[labelVolume],
+			Volume:       v.Name,
+			DeploymentId: v.Labels[labelDeployment],
+			Snapshot:     v.Labels[labelSnapshot],
+			CreatedAt:    createdAt,
+		}
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Volume < infos[j].Volume
+	})
+
+	return infos, nil
+}
+
+// SnapshotVolume copies the app volume, or the copy of a deployment, into a
+// new snapshot volume
+func (a *App) SnapshotVolume(name string, deployment *Deployment) (string, error) {
+	v, ok := a.findVolume(name)
+	if !ok {
+		return "", errors.New("Unknown volume")
+	}
+
+	source := a.getVolumeName(name)
+	if deployment != nil {
+		source = deployment.getVolumeName(name)
+	}
+	if _, err := docker.VolumeInspect(context.Background(), source); err != nil {
+		return "", err
+	}
+
+	snapshotId := strings.ToLower(makeId())
+	snapshot := fmt.Sprintf("%s-snapshot-%s", a.getVolumeName(name), snapshotId)
+	err := dockerCreateVolume(snapshot, map[string]string{
+		labelApp:      a.Id,
+		labelVolume:   name,
+		labelSnapshot: snapshotId,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("[Volumes] Snapshot %s -> %s", source, snapshot)
+	err = dockerCopyVolume(source, snapshot, v.Pause, io.Discard)
+	if err != nil {
+		dockerRemoveVolume(snapshot)
+		return "", err
+	}
+
+	return snapshotId, nil
+}
+
+// DeleteSnapshot removes a snapshot volume of the app
+func (a *App) DeleteSnapshot(name, snapshotId string) error {
+	volumes, err := dockerListVolumes(map[string]string{
+		labelApp:      a.Id,
+		labelVolume:   name,
+		labelSnapshot: snapshotId,
+	})
+	if err != nil {
+		return err
+	}
+	if len(volumes) == 0 {
+		return errors.New("Unknown snapshot")
+	}
+
+	return dockerRemoveVolume(volumes[0].Name)
+}
+
+// DeleteVolume removes the volume from the app together with all its docker
+// volumes. Fails while containers still use them
+func (a *App) DeleteVolume(name string) error {
+	if _, ok := a.findVolume(name); !ok {
+		return errors.New("Unknown volume")
+	}
+
+	err := a.removeVolumes(map[string]string{labelApp: a.Id, labelVolume: name})
+	if err != nil {
+		return err
+	}
+
+	a.Volumes = lo.Filter(a.Volumes, func(v Volume, _ int) bool {
+		return v.Name != name
+	})
+	return nil
+}
+
+// removeVolumes removes all docker volumes of the app matching labels
+func (a *App) removeVolumes(labels map[string]string) error {
+	volumes, err := dockerListVolumes(labels)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, v := range volumes {
+		errs = append(errs, dockerRemoveVolume(v.Name))
+	}
+	return errors.Join(errs...)
+}
+
+// getVolumeName returns the docker volume the deployment mounts
+func (d *Deployment) getVolumeName(name string) string {
+	v, _ := d.App.findVolume(name)
+	if v.GetMode() == VolumeCopy {
+		return fmt.Sprintf("%s-%s", d.App.getVolumeName(name), strings.ToLower(d.Id))
+	}
+	return d.App.getVolumeName(name)
+}
+
+// mountVolumes adds the app volumes to the container spec. Copies are created
+// the first time a container of the deployment mounts them
+func (d *Deployment) mountVolumes(spec *ContainerSpec, buildLog *LogFile) error {
+	if len(d.App.Volumes) == 0 {
+		return nil
+	}
+
+	spec.Volumes = make(map[string]string)
+	for _, v := range d.App.Volumes {
+		base := d.App.getVolumeName(v.Name)
+		err := dockerCreateVolume(base, map[string]string{
+			labelApp:    d.App.Id,
+			labelVolume: v.Name,
+		})
+		if err != nil {
+			return err
+		}
+
+		name := d.getVolumeName(v.Name)
+		if v.GetMode() == VolumeCopy {
+			err = d.copyVolume(v, name, buildLog)
+			if err != nil {
+				return err
+			}
+		}
+
+		spec.Volumes[name] = v.Path
+	}
+
+	return nil
+}
+
+// copyVolume creates the copy of the volume for the deployment, unless it
+// already exists
+func (d *Deployment) copyVolume(v Volume, name string, buildLog *LogFile) error {
+	_, err := docker.VolumeInspect(context.Background(), name)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+
+	// Continue with the data of the current deployment of the branch
+	source := d.App.getVolumeName(v.Name)
+	if id, ok := d.App.getAlias(d.GitBranch); ok && id != d.Id {
+		if current := getDeploymentById(id); current != nil {
+			branchVolume := current.getVolumeName(v.Name)
+			if _, err := docker.VolumeInspect(context.Background(), branchVolume); err == nil {
+				source = branchVolume
+			}
+		}
+	}
+
+	err = dockerCreateVolume(name, map[string]string{
+		labelApp:        d.App.Id,
+		labelVolume:     v.Name,
+		labelDeployment: d.Id,
+	})
+	if err != nil {
+		return err
+	}
+
+	buildLog.Printf("Copying volume %s from %s", v.Name, source)
+	err = dockerCopyVolume(source, name, v.Pause, buildLog)
+	if err != nil {
+		// Otherwise the next start would mount the incomplete copy
+		if removeErr := dockerRemoveVolume(name); removeErr != nil {
+			log.Println("[Volumes]", removeErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// removeVolumes removes the volume copies of the deployment
+func (d *Deployment) removeVolumes() {
+	err := d.App.removeVolumes(map[string]string{
+		labelApp:        d.App.Id,
+		labelDeployment: d.Id,
+	})
+	if err != nil {
+		log.Println("[Volumes]", err)
+	}
+}
+
+func dockerCreateVolume(name string, labels map[string]string) error {
+	_, err := docker.VolumeCreate(context.Background(), volume.CreateOptions{
+		Name:   name,
+		Labels: labels,
+	})
+	return err
+}
+
+func dockerListVolumes(labels map[string]string) ([]*volume.Volume, error) {
+	args := filters.NewArgs()
+	for key, value := range labels {
+		args.Add("label", fmt.Sprintf("%s=%s", key, value))
+	}
+
+	res, err := docker.VolumeList(context.Background(), volume.ListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	return res.Volumes, nil
+}
+
+// dockerPauseVolumeUsers pauses all running containers that mount the volume
+// and returns their ids
+func dockerPauseVolumeUsers(name string) ([]string, error) {
+	containers, err := docker.ContainerList(context.Background(), types.ContainerListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("volume", name),
+			filters.Arg("status", "running"),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var paused []string
+	for _, c := range containers {
+		err = docker.ContainerPause(context.Background(), c.ID)
+		if err != nil {
+			return paused, err
+		}
+		paused = append(paused, c.ID)
+	}
+
+	return paused, nil
+}
+
+func dockerRemoveVolume(name string) error {
+	err := docker.VolumeRemove(context.Background(), name, false)
+	if client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// dockerCopyVolume copies all files of volume from into volume to using a
+// one-off container of the volume helper image. With pause, running containers
+// using the source volume are paused meanwhile, so files are not copied
+// mid-write
+func dockerCopyVolume(from, to string, pause bool, logs io.Writer) error {
+	image, err := dockerEnsureImage(volumeHelperImage, pullPolicy, logs)
+	if err != nil {
+		return err
+	}
+
+	var paused []string
+	if pause {
+		paused, err = dockerPauseVolumeUsers(from)
+	}
+	defer func() {
+		for _, id := range paused {
+			if err := docker.ContainerUnpause(context.Background(), id); err != nil {
+				log.Println("[Volumes]", err)
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	containerId, err := dockerRun(ContainerSpec{
+		Image:   image,
+		Cmd:     []string{"/bin/sh", "-c", "cp -a /from/. /to/"},
+		Volumes: map[string]string{from: "/from", to: "/to"},
+	})
+	if containerId != "" {
+		defer dockerRemove(containerId)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = dockerFollowLogs(containerId, logs)
+	if err != nil {
+		return err
+	}
+
+	state, err := dockerWait(containerId)
+	if err != nil {
+		return err
+	}
+	if state.ExitCode != 0 {
+		return fmt.Errorf("Copying volume %s failed with code %d", from, state.ExitCode)
+	}
+
+	return nil
+}
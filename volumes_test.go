@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestVolumeValidate(t *testing.T) {
+	tests := []struct {
+		volume  Volume
+		wantErr bool
+	}{
+		{Volume{Name: "data", Path: "/data"}, false},
+		{Volume{Name: "uploads_2", Path: "/app/uploads", Mode: VolumeCopy}, false},
+		{Volume{Name: "db", Path: "/var/lib/db", Mode: VolumeShared}, false},
+		{Volume{Name: "", Path: "/data"}, true},
+		{Volume{Name: "Data", Path: "/data"}, true},
+		// "-" joins the parts of docker volume names
+		{Volume{Name: "data-abc", Path: "/data"}, true},
+		{Volume{Name: "data", Path: "data"}, true},
+		{Volume{Name: "data", Path: "/"}, true},
+		{Volume{Name: "data", Path: "/runner"}, true},
+		{Volume{Name: "data", Path: "/runner/db"}, true},
+		{Volume{Name: "data", Path: "/runner-data"}, false},
+		{Volume{Name: "data", Path: "/data", Mode: "snapshot"}, true},
+	}
+
+	for _, test := range tests {
+		err := test.volume.Validate()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%+v.Validate() = %v, want error: %v", test.volume, err, test.wantErr)
+		}
+	}
+}
+
+func TestVolumeNames(t *testing.T) {
+	app := &App{
+		Id: "AppId",
+		Volumes: []Volume{
+			{Name: "shared", Path: "/shared"},
+			{Name: "copied", Path: "/copied", Mode: VolumeCopy},
+		},
+	}
+	deployment := &Deployment{Id: "DeploymentId", App: app}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"shared", "runner-appid-shared"},
+		{"copied", "runner-appid-copied-deploymentid"},
+	}
+
+	for _, test := range tests {
+		if got := deployment.getVolumeName(test.name); got != test.want {
+			t.Errorf("getVolumeName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if err := app.SetVolume(Volume{Name: "other", Path: "/shared/"}); err == nil {
+		t.Error("SetVolume accepted a path that is already used")
+	}
+	if err := app.SetVolume(Volume{Name: "shared", Path: "/new"}); err != nil {
+		t.Errorf("SetVolume did not replace the volume: %v", err)
+	}
+}